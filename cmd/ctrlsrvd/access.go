@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// networkPolicy is a set of networks allowed to reach a group of routes
+type networkPolicy struct {
+	name     string
+	prefixes []string
+	networks []*net.IPNet
+	// open allows every address; used when no networks are configured at all
+	open bool
+}
+
+// allows reports whether ip may use routes under this policy. Direct
+// loopback connections are always allowed so the kiosk keeps working;
+// forwarded ones are checked like any other address.
+func (p *networkPolicy) allows(ip net.IP, forwarded bool) bool {
+	if p.open || (ip.IsLoopback() && !forwarded) {
+		return true
+	}
+	for _, n := range p.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessControl restricts requests by client address. Each request is
+// checked against the group with the longest matching path prefix, or the
+// default policy from wireguard.allowed_networks.
+type AccessControl struct {
+	defaultPolicy  *networkPolicy
+	groups         []*networkPolicy
+	trustedProxies []*net.IPNet
+}
+
+// parseNetworks parses CIDRs or single addresses
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network: %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %q", entry)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// NewAccessControl builds access policies from the configuration
+func NewAccessControl(cfg *Config) (*AccessControl, error) {
+	networks, err := parseNetworks(cfg.WireGuard.AllowedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard.allowed_networks: %w", err)
+	}
+	ac := &AccessControl{
+		defaultPolicy: &networkPolicy{name: "default", networks: networks, open: len(networks) == 0},
+	}
+
+	if ac.trustedProxies, err = parseNetworks(cfg.Access.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("access.trusted_proxies: %w", err)
+	}
+
+	for _, g := range cfg.Access.Groups {
+		if len(g.Prefixes) == 0 {
+			return nil, fmt.Errorf("access group %q has no prefixes", g.Name)
+		}
+		networks, err := parseNetworks(g.Networks)
+		if err != nil {
+			return nil, fmt.Errorf("access group %q: %w", g.Name, err)
+		}
+		ac.groups = append(ac.groups, &networkPolicy{name: g.Name, prefixes: g.Prefixes, networks: networks})
+	}
+	return ac, nil
+}
+
+// policyFor returns the policy for a request path
+func (ac *AccessControl) policyFor(path string) *networkPolicy {
+	best, bestLen := ac.defaultPolicy, -1
+	for _, g := range ac.groups {
+		for _, prefix := range g.prefixes {
+			if strings.HasPrefix(path, prefix) && len(prefix) > bestLen {
+				best, bestLen = g, len(prefix)
+			}
+		}
+	}
+	return best
+}
+
+// trusted reports whether ip is a configured reverse proxy
+func (ac *AccessControl) trusted(ip net.IP) bool {
+	for _, n := range ac.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client behind r and whether it was
+// taken from a forwarding header. Headers are only believed when the
+// connection comes from a trusted proxy, and X-Forwarded-For is read right
+// to left so clients cannot spoof it.
+func (ac *AccessControl) ClientIP(r *http.Request) (net.IP, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ac.trusted(ip) {
+		return ip, false
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		forwarded := false
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip, forwarded = hop, true
+			if !ac.trusted(hop) {
+				break
+			}
+		}
+		return ip, forwarded
+	}
+	if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+		return real, true
+	}
+	return ip, false
+}
+
+// hasProxyHeaders reports whether r carries a header a reverse proxy adds
+func hasProxyHeaders(r *http.Request) bool {
+	for _, h := range []string{"X-Forwarded-For", "X-Real-IP", "Forwarded"} {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// clientInfo is the resolved client address of a request
+type clientInfo struct {
+	ip        net.IP
+	forwarded bool
+}
+
+type clientKey struct{}
+
+// clientIPFrom returns the client address resolved by the access
+// middleware and whether it came through a proxy
+func clientIPFrom(r *http.Request) (net.IP, bool) {
+	c, _ := r.Context().Value(clientKey{}).(clientInfo)
+	return c.ip, c.forwarded
+}
+
+// Middleware rejects requests from addresses outside the policy for their
+// route with 403, and records the resolved client address for handlers
+func (ac *AccessControl) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, forwarded := ac.ClientIP(r)
+		// A proxy on this host that is not in trusted_proxies still must not
+		// make its remote clients look local
+		forwarded = forwarded || viaTunnel(r) || hasProxyHeaders(r)
+		policy := ac.policyFor(r.URL.Path)
+		if ip == nil || !policy.allows(ip, forwarded) {
+			httpLog.WarnContext(r.Context(), "Access denied from this network", "method", r.Method, "path", r.URL.Path, "client", ip, "remote", r.RemoteAddr, "policy", policy.name)
+			if isAPIRequest(r) {
+				jsonError(w, http.StatusForbidden, "access denied from this network")
+			} else {
+				http.Error(w, "Access denied from this network", http.StatusForbidden)
+			}
+			return
+		}
+		ctx := context.WithValue(r.Context(), clientKey{}, clientInfo{ip: ip, forwarded: forwarded})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
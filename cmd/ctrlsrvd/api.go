@@ -1,45 +1,257 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"log"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // APIServer handles HTTP API requests
 type APIServer struct {
-	config *Config
-	mux    *http.ServeMux
+	// config and access are replaced as a whole when the configuration is
+	// reloaded; see ReloadConfig
+	config    atomic.Pointer[Config]
+	mux       *http.ServeMux
+	backups   *BackupManager
+	scrub     *Scrubber
+	removable *RemovableManager
+	search    *SearchIndex
+	thumbs    *ThumbnailService
+	shares    *ShareManager
+	dupes     *DuplicateFinder
+	quotas    *QuotaManager
+	auth      *AuthManager
+	access    atomic.Pointer[AccessControl]
+	ca        *CertAuthority
+	tunnel    *Tunnel
+	events    *EventBus
+	metrics   *Metrics
+	audit     *AuditLog
+	server    *http.Server
+
+	// metricsServer serves /metrics when server.metrics_addr is set
+	metricsServer *http.Server
+
+	// ctx is cancelled when background work should stop; tasks tracks the
+	// workers and the operations handlers start, so shutdown can wait
+	ctx   context.Context
+	tasks sync.WaitGroup
+
+	reloadMu sync.Mutex
+
+	// logins slows down password guessing on /login and share links
+	logins *loginThrottle
 }
 
 // NewAPIServer creates a new API server
 func NewAPIServer(cfg *Config) *APIServer {
+	access, err := NewAccessControl(cfg)
+	if err != nil {
+		fatal(mainLog, "Invalid access configuration", "error", err)
+	}
+
 	s := &APIServer{
-		config: cfg,
-		mux:    http.NewServeMux(),
+		mux:       http.NewServeMux(),
+		backups:   NewBackupManager(cfg),
+		scrub:     NewScrubber(cfg),
+		removable: NewRemovableManager(cfg),
+		search:    NewSearchIndex(cfg),
+		thumbs:    NewThumbnailService(cfg),
+		shares:    NewShareManager(cfg),
+		dupes:     NewDuplicateFinder(cfg),
+		quotas:    NewQuotaManager(cfg),
+		auth:      NewAuthManager(cfg),
+		metrics:   NewMetrics(),
+		audit:     NewAuditLog(cfg),
+		ctx:       context.Background(),
+		logins:    newLoginThrottle(),
+	}
+	s.config.Store(cfg)
+	s.access.Store(access)
+	if cfg.CA.Enabled {
+		if s.ca, err = NewCertAuthority(cfg); err != nil {
+			fatal(mainLog, "Failed to set up internal CA", "error", err)
+		}
 	}
 
 	// UI routes
-	s.mux.HandleFunc("/", s.handleRoot)
-	s.mux.HandleFunc("/printer", s.handlePrinterPage)
-	s.mux.HandleFunc("/files", s.handleFilesPage)
-	s.mux.HandleFunc("/storage", s.handleStoragePage)
-	s.mux.HandleFunc("/services", s.handleServicesPage)
+	s.handle("/", policyViewer, s.handleRoot)
+	s.handle("/printer", policyViewer, s.handlePrinterPage)
+	s.handle("/files", policyViewer, s.handleFilesPage)
+	s.handle("/storage", policyViewer, s.handleStoragePage)
+	s.handle("/storage/duplicates", policyViewer, s.handleDuplicatesPage)
+	s.handle("/services", policyViewer, s.handleServicesPage)
+	s.handle("/removable", policyViewer, s.handleRemovablePage)
+	s.handle("/search", policyViewer, s.handleSearchPage)
+	s.handle("/account", policySelf, s.handleAccountPage)
+	s.handle("/settings", policyAdmin, s.handleSettingsPage)
+	s.handle("/logs", policyAdmin, s.handleLogsPage)
+	s.handle("/login", policyPublic, s.handleLogin)
+	s.handle("/logout", policyPublic, s.handleLogout)
+
+	// Public share links, reachable through the edge via QUIC
+	s.handle("/s/", policyPublic, s.handleShareLink)
 
 	// API routes
-	s.mux.HandleFunc("/api/health", s.handleHealth)
-	s.mux.HandleFunc("/api/storage", s.handleStorageAPI)
-	s.mux.HandleFunc("/api/printing/queues", s.handlePrintQueues)
-	s.mux.HandleFunc("/api/services", s.handleServicesAPI)
+	s.handle("/api/health", policyPublic, s.handleHealth)
+	s.handle("/api/storage", policyViewer, s.handleStorageAPI)
+	s.handle("/api/storage/scrub", policyViewer, s.handleScrubAPI)
+	s.handle("/api/storage/scrub/accept", policyOperator, s.handleScrubAccept)
+	s.handle("/api/storage/duplicates", policyViewer, s.handleDuplicatesAPI)
+	s.handle("/api/storage/duplicates/apply", policyOperator, s.handleDuplicatesApply)
+	s.handle("/api/printing/queues", policyViewer, s.handlePrintQueues)
+	s.handle("/api/services", policyViewer, s.handleServicesAPI)
+	s.handle("/api/backup", policyViewer, s.handleBackupAPI)
+	s.handle("/api/backup/run", policyOperator, s.handleBackupRun)
+	s.handle("/api/backup/verify", policyOperator, s.handleBackupVerify)
+	s.handle("/api/backup/prune", policyOperator, s.handleBackupPrune)
+	s.handle("/api/backup/restore", policyAdmin, s.handleBackupRestore)
+	s.handle("/api/search", policyViewer, s.handleSearchAPI)
+	s.handle("/api/files/thumb", policyViewer, s.handleThumbnail)
+	s.handle("/api/files/upload", policyOperator, s.handleUpload)
+	s.handle("/api/files/archive", policyViewer, s.handleArchive)
+	s.handle("/api/shares", policyOperator, s.handleSharesAPI)
+	s.handle("/api/removable", policyViewer, s.handleRemovableAPI)
+	s.handle("/api/removable/mount", policyOperator, s.handleRemovableMount)
+	s.handle("/api/removable/unmount", policyOperator, s.handleRemovableUnmount)
+	s.handle("/api/removable/import", policyOperator, s.handleRemovableImport)
+	s.handle("/api/auth/me", policySelf, s.handleAuthMe)
+	s.handle("/api/auth/password", policySelf, s.handleAuthPassword)
+	s.handle("/api/auth/tokens", policySelf, s.handleAuthTokens)
+	s.handle("/api/auth/users", policyAdmin, s.handleAuthUsers)
+	s.handle("/api/ca/root", policyPublic, s.handleCARoot)
+	s.handle("/api/ca/crl", policyPublic, s.handleCACRL)
+	s.handle("/api/ca/certs", policyAdmin, s.handleCACerts)
+	s.handle("/api/tunnel", policyViewer, s.handleTunnelAPI)
+	s.handle("/api/tunnel/migrate", policyOperator, s.handleTunnelMigrate)
+	s.handle("/api/config", policyAdmin, s.handleConfigAPI)
+	s.handle("/api/config/reload", policyAdmin, s.handleConfigReload)
+	s.handle("/api/logs", policyAdmin, s.handleLogsAPI)
+	s.handle("/api/audit", policyAdmin, s.handleAuditAPI)
+
+	s.handle("/api/events", policyViewer, s.handleEvents)
+
+	// The tunnel serves the same handler, access control included
+	s.tunnel = NewTunnel(cfg, s.Handler())
+	s.events = NewEventBus([]eventTopic{
+		{"health", 5 * time.Second, func() any { return s.health() }},
+		{"storage", 10 * time.Second, func() any { return s.storageStatus() }},
+		{"printing", 3 * time.Second, func() any { return s.printQueues() }},
+		{"services", 5 * time.Second, func() any { return servicesStatus() }},
+		{"tunnel", 5 * time.Second, func() any { return s.tunnel.Status() }},
+		{"backup", 5 * time.Second, func() any { return BackupResponse{Status: s.backups.Status()} }},
+		{"removable", 2 * time.Second, func() any { return s.removableStatus() }},
+	})
+	s.server = &http.Server{
+		Addr:    cfg.Server.ListenAddr,
+		Handler: s.Handler(),
+		// No read or write timeout: uploads and archive downloads can
+		// legitimately take hours
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if cfg.Server.MetricsAddr != "" {
+		s.metricsServer = &http.Server{
+			Addr:              cfg.Server.MetricsAddr,
+			Handler:           s.metricsHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
 
 	return s
 }
 
-// Start starts the API server
+// Handler returns the HTTP handler shared by the HTTP and QUIC listeners,
+// with request logging, auditing and the current network access control
+// applied
+func (s *APIServer) Handler() http.Handler {
+	return logRequests(s.audited(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.access.Load().Middleware(s.mux).ServeHTTP(w, r)
+	})))
+}
+
+// RunBackground starts the periodic workers. They stop when ctx is
+// cancelled, as do operations started through the API afterwards.
+func (s *APIServer) RunBackground(ctx context.Context) {
+	s.ctx = ctx
+	s.goTask(s.backups.Run)
+	s.goTask(s.scrub.Run)
+	s.goTask(s.removable.Run)
+	s.goTask(s.search.Run)
+	s.goTask(s.thumbs.Run)
+	s.goTask(s.quotas.Run)
+	s.goTask(s.tunnel.Run)
+	s.goTask(s.events.Run)
+}
+
+// goTask runs fn in the background with the server's background context
+func (s *APIServer) goTask(fn func(ctx context.Context)) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		fn(s.ctx)
+	}()
+}
+
+// Start starts the API server. It returns http.ErrServerClosed after
+// Shutdown.
 func (s *APIServer) Start() error {
-	log.Printf("API server listening on %s", s.config.Server.ListenAddr)
-	return http.ListenAndServe(s.config.Server.ListenAddr, s.mux)
+	httpLog.Info("API server listening", "addr", s.config.Load().Server.ListenAddr)
+	return s.server.ListenAndServe()
+}
+
+// Shutdown stops accepting requests on the HTTP listener and the edge
+// tunnel and waits for in-flight ones to finish. When ctx expires the
+// remaining connections are closed.
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	s.events.Close()
+	tunnelErr := make(chan error, 1)
+	go func() { tunnelErr <- s.tunnel.Shutdown(ctx) }()
+
+	if s.metricsServer != nil {
+		s.metricsServer.Shutdown(ctx)
+	}
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		s.server.Close()
+	}
+	return errors.Join(err, <-tunnelErr)
+}
+
+// Wait blocks until background workers and operations have returned after
+// their context was cancelled, or ctx expires
+func (s *APIServer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		s.dupes.Wait()
+		s.removable.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Common HTML template
@@ -111,6 +323,14 @@ func (s *APIServer) renderPage(w http.ResponseWriter, title, content string) {
         th, td { padding: 12px; text-align: left; border-bottom: 1px solid rgba(255,255,255,0.1); }
         th { font-weight: 600; }
     </style>
+    <script>
+        // esc escapes text from the server, such as file names, drive
+        // labels and error messages, for use in HTML and attribute values
+        function esc(s) {
+            return String(s ?? '').replace(/[&<>"']/g, c =>
+                ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+        }
+    </script>
 </head>
 <body>
     <div class="header">
@@ -157,6 +377,18 @@ func (s *APIServer) handleRoot(w http.ResponseWriter, r *http.Request) {
         }
         .header h1 { font-size: 2.5em; margin-bottom: 10px; }
         .status { font-size: 1.3em; opacity: 0.9; }
+        .search { margin-top: 15px; }
+        .search input {
+            width: 100%;
+            max-width: 600px;
+            padding: 15px 20px;
+            border-radius: 10px;
+            border: 2px solid rgba(255,255,255,0.3);
+            background: rgba(255,255,255,0.15);
+            color: white;
+            font-size: 1.2em;
+        }
+        .search input::placeholder { color: rgba(255,255,255,0.7); }
         .container {
             flex: 1;
             padding: 20px;
@@ -200,6 +432,9 @@ func (s *APIServer) handleRoot(w http.ResponseWriter, r *http.Request) {
     <div class="header">
         <h1>ctrlsrv</h1>
         <div class="status" id="status">✅ System Online</div>
+        <form class="search" action="/search" method="get">
+            <input type="search" name="q" placeholder="🔍 Search files...">
+        </form>
     </div>
     
     <div class="container">
@@ -222,27 +457,43 @@ func (s *APIServer) handleRoot(w http.ResponseWriter, r *http.Request) {
             <div class="icon">⚙️</div>
             <div class="label">Services</div>
         </a>
+
+        <a href="/removable" class="card">
+            <div class="icon">🔌</div>
+            <div class="label">USB Drives</div>
+        </a>
+
+        <a href="/account" class="card">
+            <div class="icon">👤</div>
+            <div class="label">Account</div>
+        </a>
+
+        <a href="/settings" class="card">
+            <div class="icon">🛠️</div>
+            <div class="label">Settings</div>
+        </a>
+
+        <a href="/logs" class="card">
+            <div class="icon">📜</div>
+            <div class="label">Logs</div>
+        </a>
     </div>
     
     <script>
-        // Update status every 5 seconds
-        async function updateStatus() {
-            try {
-                const res = await fetch('/api/health');
-                const data = await res.json();
-                const status = document.getElementById('status');
-                if (data.status === 'ok') {
-                    status.textContent = '✅ System Online';
-                } else {
-                    status.textContent = '⚠️ System Degraded';
-                }
-            } catch(e) {
-                document.getElementById('status').textContent = '❌ Connection Lost';
+        // The server pushes health whenever it changes
+        const status = document.getElementById('status');
+        const events = new EventSource('/api/events?topics=health');
+        events.addEventListener('health', e => {
+            const data = JSON.parse(e.data);
+            if (data.alerts && data.alerts.length > 0) {
+                status.textContent = '⚠️ ' + data.alerts[0];
+            } else if (data.status === 'ok') {
+                status.textContent = '✅ System Online';
+            } else {
+                status.textContent = '⚠️ System Degraded';
             }
-        }
-        
-        updateStatus();
-        setInterval(updateStatus, 5000);
+        });
+        events.onerror = () => { status.textContent = '❌ Connection Lost'; };
     </script>
 </body>
 </html>`
@@ -278,9 +529,7 @@ func (s *APIServer) handlePrinterPage(w http.ResponseWriter, r *http.Request) {
 		</div>
 		
 		<script>
-		async function updateQueue() {
-			const res = await fetch('/api/printing/queues');
-			const data = await res.json();
+		function updateQueue(data) {
 			const tbody = document.getElementById('queue');
 			if (data.queues && data.queues.length > 0) {
 				const queue = data.queues[0];
@@ -291,10 +540,10 @@ func (s *APIServer) handlePrinterPage(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		updateQueue();
-		setInterval(updateQueue, 3000);
+		const events = new EventSource('/api/events?topics=printing');
+		events.addEventListener('printing', e => updateQueue(JSON.parse(e.data)));
 		</script>
-	`, s.config.CUPS.Printer)
+	`, s.config.Load().CUPS.Printer)
 
 	s.renderPage(w, "Print Queue", content)
 }
@@ -325,6 +574,126 @@ func (s *APIServer) handleFilesPage(w http.ResponseWriter, r *http.Request) {
 				Open File Manager
 			</button>
 		</div>
+
+		<div class="card">
+			<h2>📦 Download Folder</h2>
+			<form onsubmit="previewArchive(); return false;">
+				<input id="archive-path" class="btn" placeholder="Folder, e.g. scans">
+				<select id="archive-format" class="btn">
+					<option value="zip">ZIP</option>
+					<option value="tar.gz">tar.gz</option>
+				</select>
+				<input id="archive-include" class="btn" placeholder="Include, e.g. *.pdf">
+				<input id="archive-exclude" class="btn" placeholder="Exclude, e.g. *.tmp">
+				<button class="btn" type="submit">Preview</button>
+			</form>
+			<p id="archive-preview" style="margin-top: 10px;"></p>
+		</div>
+
+		<div class="card">
+			<h2>🔗 Share Links</h2>
+			<form onsubmit="createShare(); return false;">
+				<input id="share-path" class="btn" placeholder="Path, e.g. scans/letter.pdf" required>
+				<select id="share-expiry" class="btn">
+					<option value="1h">1 hour</option>
+					<option value="24h" selected>1 day</option>
+					<option value="168h">1 week</option>
+				</select>
+				<input id="share-password" class="btn" type="password" placeholder="Password (optional)">
+				<button class="btn" type="submit">Create Link</button>
+			</form>
+			<table>
+				<thead>
+					<tr>
+						<th>Path</th>
+						<th>Expires</th>
+						<th>Downloads</th>
+						<th></th>
+					</tr>
+				</thead>
+				<tbody id="shares"></tbody>
+			</table>
+		</div>
+
+		<script>
+		function archiveParams() {
+			const params = new URLSearchParams();
+			params.set('path', document.getElementById('archive-path').value);
+			params.set('format', document.getElementById('archive-format').value);
+			for (const key of ['include', 'exclude']) {
+				const value = document.getElementById('archive-' + key).value;
+				if (value) params.set(key, value);
+			}
+			return params;
+		}
+
+		async function previewArchive() {
+			const params = archiveParams();
+			const div = document.getElementById('archive-preview');
+			const res = await fetch('/api/files/archive?preview=true&' + params);
+			const data = await res.json();
+			if (!res.ok) {
+				div.innerHTML = '<span class="status-error">' + esc(data.error) + '</span>';
+				return;
+			}
+			div.innerHTML = data.files + ' files, ' + (data.bytes / 1048576).toFixed(1) + ' MB ' +
+				(data.files > 0 ? '<a class="btn" href="/api/files/archive?' + params + '">Download</a>' : '');
+		}
+
+		async function loadShares() {
+			const res = await fetch('/api/shares');
+			const data = await res.json();
+			const tbody = document.getElementById('shares');
+			tbody.innerHTML = data.shares.map(sh => {
+				let state = esc(new Date(sh.expires).toLocaleString());
+				if (sh.revoked) state = '<span class="status-error">Revoked</span>';
+				else if (sh.expired) state = '<span class="status-warn">Expired</span>';
+				// Paths are file names anyone with write access to storage chooses
+				return '<tr><td>' + (sh.has_password ? '🔒 ' : '') + esc(sh.path) + '</td><td>' + state +
+					'</td><td>' + sh.downloads + (sh.max_downloads ? ' / ' + sh.max_downloads : '') +
+					'</td><td></td></tr>';
+			}).join('');
+
+			// Buttons get handlers rather than inline scripts built from data
+			data.shares.forEach((sh, i) => {
+				if (sh.revoked) return;
+				const cell = tbody.rows[i].cells[3];
+				for (const [label, action] of [['Link', () => prompt('Share link', sh.url)], ['Revoke', () => revokeShare(sh.id)]]) {
+					const button = document.createElement('button');
+					button.className = 'btn';
+					button.textContent = label;
+					button.addEventListener('click', action);
+					cell.appendChild(button);
+				}
+			});
+		}
+
+		async function createShare() {
+			const res = await fetch('/api/shares', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify({
+					path: document.getElementById('share-path').value,
+					expires_in: document.getElementById('share-expiry').value,
+					password: document.getElementById('share-password').value
+				})
+			});
+			const data = await res.json();
+			if (!res.ok) {
+				alert(data.error);
+				return;
+			}
+			prompt('Share link', data.url);
+			loadShares();
+		}
+
+		async function revokeShare(id) {
+			await fetch('/api/shares?id=' + encodeURIComponent(id), { method: 'DELETE' });
+			loadShares();
+		}
+
+		loadShares();
+		</script>
 	`
 
 	s.renderPage(w, "Files", content)
@@ -337,203 +706,2399 @@ func (s *APIServer) handleStoragePage(w http.ResponseWriter, r *http.Request) {
 			<h2>💾 Storage Status</h2>
 			<div id="storage-info">Loading...</div>
 		</div>
-		
+
+		<div class="card" id="quota-card" style="display: none;">
+			<h2>📊 Share Quotas</h2>
+			<div id="quota-info"></div>
+		</div>
+
+		<div class="card">
+			<h2>🗄️ Backups</h2>
+			<div id="backup-info">Loading...</div>
+			<button class="btn" onclick="backupAction('run')">Back Up Now</button>
+			<button class="btn" onclick="backupAction('verify')">Verify</button>
+			<button class="btn" onclick="backupAction('prune')">Prune</button>
+		</div>
+
+		<div class="card">
+			<h2>🧬 Duplicate Files</h2>
+			<p>Find files with identical content and reclaim the space.</p>
+			<a class="btn" href="/storage/duplicates">Review Duplicates</a>
+		</div>
+
 		<script>
-		async function updateStorage() {
-			try {
-				const res = await fetch('/api/storage');
-				const data = await res.json();
-				const div = document.getElementById('storage-info');
-				
-				if (!data.available) {
-					div.innerHTML = '<p class="status-error">⚠️ Storage not available!</p>';
-					return;
+		function gb(bytes) {
+			return (bytes / 1024 / 1024 / 1024).toFixed(2);
+		}
+
+		function updateStorage(data) {
+			const div = document.getElementById('storage-info');
+
+			div.innerHTML = data.volumes.map(v => {
+				const title = '<h3>' + esc(v.name) + ' <small>(' + esc(v.role) +
+					(v.mandatory ? ', mandatory' : ', optional') + ')</small></h3>';
+				const services = v.services.length > 0 ? esc(v.services.join(', ')) : '-';
+
+				if (!v.available) {
+					const cls = v.mandatory ? 'status-error' : 'status-warn';
+					return title + '<table>' +
+						'<tr><td>Path:</td><td><code>' + esc(v.path) + '</code></td></tr>' +
+						'<tr><td>Status:</td><td class="' + cls + '">⚠️ ' + esc(v.error) + '</td></tr>' +
+						'<tr><td>Services:</td><td>' + services + '</td></tr>' +
+						'</table>';
 				}
-				
-				const used = (data.used_bytes / 1024 / 1024 / 1024).toFixed(2);
-				const total = (data.total_bytes / 1024 / 1024 / 1024).toFixed(2);
-				const free = (data.free_bytes / 1024 / 1024 / 1024).toFixed(2);
-				const pct = data.used_percent.toFixed(1);
-				
+
+				const pct = v.used_percent.toFixed(1);
 				let statusClass = 'status-ok';
 				if (pct > 90) statusClass = 'status-error';
 				else if (pct > 80) statusClass = 'status-warn';
-				
-				div.innerHTML = '
-	<table>
-	<tr><td>Path:</td><td><code>\${data.path}</code></td></tr>
-	<tr><td>Status:</td><td class="status-ok">✅ Mounted</td></tr>
-	<tr><td>Used:</td><td>\${used} GB</td></tr>
-	<tr><td>Free:</td><td>\${free} GB</td></tr>
-	<tr><td>Total:</td><td>\${total} GB</td></tr>
-	<tr><td>Usage:</td><td class="\${statusClass}">\${pct}%</td></tr>
-	</table>
-	\';
+
+				return title + '<table>' +
+					'<tr><td>Path:</td><td><code>' + esc(v.path) + '</code></td></tr>' +
+					'<tr><td>Status:</td><td class="status-ok">✅ Mounted</td></tr>' +
+					'<tr><td>Used:</td><td>' + gb(v.used_bytes) + ' GB</td></tr>' +
+					'<tr><td>Free:</td><td>' + gb(v.free_bytes) + ' GB</td></tr>' +
+					'<tr><td>Total:</td><td>' + gb(v.total_bytes) + ' GB</td></tr>' +
+					'<tr><td>Usage:</td><td class="' + statusClass + '">' + pct + '%</td></tr>' +
+					'<tr><td>Services:</td><td>' + services + '</td></tr>' +
+					'</table>';
+			}).join('<br>');
+
+			updateQuotas(data.quotas);
+		}
+
+		function updateQuotas(quotas) {
+			document.getElementById('quota-card').style.display = quotas.length > 0 ? 'block' : 'none';
+			document.getElementById('quota-info').innerHTML = quotas.map(q => {
+				const limit = q.hard_bytes || q.soft_bytes;
+				let cls = 'status-ok';
+				if (q.over_hard) cls = 'status-error';
+				else if (q.over_soft) cls = 'status-warn';
+
+				let detail = gb(q.used_bytes) + ' GB';
+				if (limit) detail += ' of ' + gb(limit) + ' GB (' + q.used_percent.toFixed(1) + '%)';
+				if (q.soft_bytes && q.hard_bytes) detail += ', warning at ' + gb(q.soft_bytes) + ' GB';
+				if (q.error) detail = '⚠️ ' + esc(q.error);
+
+				const color = q.over_hard ? '#e74c3c' : q.over_soft ? '#f39c12' : '#2ecc71';
+				const bar = limit ?
+					'<div style="background: rgba(255,255,255,0.2); border-radius: 5px; height: 12px; margin: 5px 0;">' +
+					'<div style="background: ' + color + '; width: ' + Math.min(q.used_percent, 100) + '%; height: 100%; border-radius: 5px;"></div></div>' : '';
+
+				return '<p><strong>' + esc(q.name) + '</strong> <code>' + esc(q.path) + '</code></p>' + bar +
+					'<p class="' + cls + '"><small>' + detail + '</small></p>';
+			}).join('<br>');
+		}
+
+		async function updateBackup() {
+			try {
+				const res = await fetch('/api/backup');
+				renderBackup(await res.json());
 			} catch (e) {
-				document.getElementById('storage-info').innerHTML = 
-					'<p class="status-error">❌ Failed to load storage info</p>';
+				document.getElementById('backup-info').innerHTML = '<p class="status-error">❌ Failed to load backup status</p>';
+			}
+		}
+
+		function renderBackup(data) {
+			const div = document.getElementById('backup-info');
+			const st = data.status;
+
+			if (!st.enabled) {
+				div.innerHTML = '<p class="status-warn">⚠️ Backups are not configured</p>';
+				return;
 			}
+
+			let state = '<span class="status-ok">✅ OK</span>';
+			if (st.operation) state = '⏳ Running ' + esc(st.operation) + '...';
+			else if (st.last_error) state = '<span class="status-error">❌ ' + esc(st.last_error) + '</span>';
+			else if (!st.last_success) state = '<span class="status-warn">⚠️ No backup yet</span>';
+
+			const fmt = t => t && !t.startsWith('0001') ? new Date(t).toLocaleString() : 'never';
+			div.innerHTML = '<table>' +
+				'<tr><td>Target:</td><td><code>' + esc(st.target) + '</code></td></tr>' +
+				'<tr><td>Status:</td><td>' + state + '</td></tr>' +
+				'<tr><td>Last success:</td><td>' + fmt(st.last_success) + '</td></tr>' +
+				'<tr><td>Next run:</td><td>' + fmt(st.next_run) + '</td></tr>' +
+				'<tr><td>Snapshots:</td><td>' + st.snapshots + '</td></tr>' +
+				'<tr><td>Repository size:</td><td>' + gb(st.repo_size_bytes) + ' GB</td></tr>' +
+				'</table>';
+		}
+
+		async function backupAction(action) {
+			const res = await fetch('/api/backup/' + action, { method: 'POST' });
+			if (!res.ok) {
+				const data = await res.json();
+				alert(data.error || 'Request failed');
+			}
+			updateBackup();
 		}
-		updateStorage();
-		setInterval(updateStorage, 10000);
+
+		const events = new EventSource('/api/events?topics=storage,backup');
+		events.addEventListener('storage', e => updateStorage(JSON.parse(e.data)));
+		events.addEventListener('backup', e => renderBackup(JSON.parse(e.data)));
 		</script>
 	`
 
 	s.renderPage(w, "Storage", content)
 }
 
-// handleServicesPage shows service status
-func (s *APIServer) handleServicesPage(w http.ResponseWriter, r *http.Request) {
+// handleDuplicatesPage shows duplicate scan results for review
+func (s *APIServer) handleDuplicatesPage(w http.ResponseWriter, r *http.Request) {
 	content := `
 		<div class="card">
-			<h2>⚙️ System Services</h2>
-			<table id="services-table">
-				<thead>
-					<tr>
-						<th>Service</th>
-						<th>Status</th>
-					</tr>
-				</thead>
-				<tbody>
-					<tr><td colspan="2">Loading...</td></tr>
-				</tbody>
-			</table>
+			<h2>🧬 Duplicate Files</h2>
+			<form onsubmit="startScan(); return false;">
+				<input id="path" class="btn" placeholder="Folder (empty for all storage)">
+				<input id="min-size" class="btn" type="number" min="0" value="1" title="Minimum size in MB"> MB
+				<button class="btn" type="submit">Scan</button>
+			</form>
+			<p id="summary" style="margin-top: 15px;">Loading...</p>
+			<div id="actions" style="display: none; margin-top: 10px;">
+				<button class="btn" onclick="apply('trash')">Move Selected to Trash</button>
+				<button class="btn" onclick="apply('hardlink')">Replace Selected with Hardlinks</button>
+			</div>
 		</div>
-		
+
+		<div id="groups"></div>
+
 		<script>
-		async function updateServices() {
-			try {
-				const res = await fetch(\'/api/services\');
+		let groups = [];
+
+		function size(bytes) {
+			if (bytes >= 1073741824) return (bytes / 1073741824).toFixed(2) + ' GB';
+			if (bytes >= 1048576) return (bytes / 1048576).toFixed(1) + ' MB';
+			return (bytes / 1024).toFixed(0) + ' KB';
+		}
+
+		async function startScan() {
+			const res = await fetch('/api/storage/duplicates', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify({
+					path: document.getElementById('path').value,
+					min_size: Math.round(parseFloat(document.getElementById('min-size').value || '0') * 1048576)
+				})
+			});
+			if (!res.ok) {
 				const data = await res.json();
-				const tbody = document.querySelector(\'#services-table tbody\');
-				
-				tbody.innerHTML = data.services.map(s => {
-					const status = s.active ? 
-						\'<span class="status-ok">✅ Active</span>\' : 
-						\'<span class="status-error">❌ Inactive</span>\';
-					return \'<tr><td>\${s.name}</td><td>\${status}</td></tr>\';
-				}).join('');
-			} catch (e) {
-				document.querySelector('#services-table tbody').innerHTML = 
-					'<tr><td colspan="2" class="status-error">Failed to load</td></tr>';
+				alert(data.error || 'Request failed');
+			}
+			update();
+		}
+
+		async function update() {
+			const res = await fetch('/api/storage/duplicates');
+			const st = await res.json();
+			const summary = document.getElementById('summary');
+
+			if (st.running) {
+				summary.textContent = '⏳ Scanning ' + (st.path || 'storage') + ': ' +
+					st.scanned_files + ' files, ' + st.hashed_files + ' hashed...';
+				setTimeout(update, 2000);
+			} else if (st.error) {
+				summary.innerHTML = '<span class="status-error">❌ ' + esc(st.error) + '</span>';
+			} else if (!st.finished || st.finished.startsWith('0001')) {
+				summary.textContent = 'No scan has been run yet.';
+			} else {
+				summary.textContent = st.groups.length + ' groups, ' + size(st.wasted_bytes) +
+					' reclaimable (scanned ' + new Date(st.finished).toLocaleString() + ')';
+			}
+
+			groups = st.running ? [] : st.groups;
+			document.getElementById('actions').style.display = groups.length > 0 ? 'block' : 'none';
+			document.getElementById('groups').innerHTML = groups.map((g, i) =>
+				'<div class="card"><h3>' + size(g.size) + ' × ' + g.files.length + '</h3><table>' +
+				'<tr><th>Keep</th><th>Remove</th><th>File</th><th>Modified</th></tr>' +
+				g.files.map((f, j) =>
+					'<tr><td><input type="radio" name="keep-' + i + '" value="' + j + '"' + (j === 0 ? ' checked' : '') + '></td>' +
+					'<td><input type="checkbox" id="rm-' + i + '-' + j + '"' + (j > 0 ? ' checked' : '') + '></td>' +
+					'<td><code>' + esc(f.path) + '</code></td>' +
+					'<td>' + new Date(f.mtime).toLocaleString() + '</td></tr>'
+				).join('') +
+				'</table></div>'
+			).join('');
+		}
+
+		async function apply(action) {
+			const label = action === 'trash' ? 'move the selected files to the trash' : 'replace the selected files with hardlinks';
+			if (!confirm('Really ' + label + '?')) return;
+
+			const errors = [];
+			let freed = 0;
+			for (let i = 0; i < groups.length; i++) {
+				const keep = document.querySelector('input[name="keep-' + i + '"]:checked').value;
+				const remove = groups[i].files
+					.filter((f, j) => j != keep && document.getElementById('rm-' + i + '-' + j).checked)
+					.map(f => f.path);
+				if (remove.length === 0) continue;
+
+				const res = await fetch('/api/storage/duplicates/apply', {
+					method: 'POST',
+					headers: { 'Content-Type': 'application/json' },
+					body: JSON.stringify({ action: action, keep: groups[i].files[keep].path, remove: remove })
+				});
+				const data = await res.json();
+				if (!res.ok) {
+					errors.push(data.error);
+					continue;
+				}
+				freed += data.freed_bytes;
+				errors.push(...data.errors);
 			}
+
+			alert(size(freed) + ' freed' + (errors.length > 0 ? '\n\nErrors:\n' + errors.join('\n') : ''));
+			update();
 		}
-		updateServices();
-		setInterval(updateServices, 5000);
+
+		update();
 		</script>
 	`
 
-	s.renderPage(w, "Services", content)
+	s.renderPage(w, "Duplicates", content)
 }
 
-// Response types
-type HealthResponse struct {
-	Status  string `json:"status"`
-	Version string `json:"version"`
-	Storage bool   `json:"storage_ok"`
-}
+// handleAccountPage shows the signed-in user, API tokens and, for admins,
+// user management
+func (s *APIServer) handleAccountPage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>👤 Account</h2>
+			<p id="me">Loading...</p>
+			<form id="password-form" onsubmit="changePassword(); return false;" style="display: none; margin-top: 10px;">
+				<input id="current" class="btn" type="password" placeholder="Current password" autocomplete="current-password">
+				<input id="new-password" class="btn" type="password" placeholder="New password" autocomplete="new-password">
+				<button class="btn" type="submit">Change Password</button>
+				<a class="btn" href="/logout">Sign Out</a>
+			</form>
+		</div>
 
-type StorageResponse struct {
-	Path      string  `json:"path"`
-	Available bool    `json:"available"`
-	Used      uint64  `json:"used_bytes"`
-	Free      uint64  `json:"free_bytes"`
-	Total     uint64  `json:"total_bytes"`
-	UsedPct   float64 `json:"used_percent"`
-}
+		<div class="card">
+			<h2>🔑 API Tokens</h2>
+			<p>Use tokens from scripts with <code>Authorization: Bearer &lt;token&gt;</code>.</p>
+			<form onsubmit="createToken(); return false;" style="margin: 10px 0;">
+				<input id="token-name" class="btn" placeholder="Name, e.g. backup script" required>
+				<select id="token-role" class="btn">
+					<option value="viewer">Viewer</option>
+					<option value="operator">Operator</option>
+					<option value="admin">Admin</option>
+				</select>
+				<select id="token-expiry" class="btn">
+					<option value="">Never expires</option>
+					<option value="720h">30 days</option>
+					<option value="8760h">1 year</option>
+				</select>
+				<button class="btn" type="submit">Create Token</button>
+			</form>
+			<table>
+				<thead><tr><th>Name</th><th>User</th><th>Role</th><th>Last used</th><th></th></tr></thead>
+				<tbody id="tokens"></tbody>
+			</table>
+		</div>
 
-type ServiceStatus struct {
-	Name    string `json:"name"`
-	Active  bool   `json:"active"`
-	Enabled bool   `json:"enabled"`
-}
+		<div class="card" id="users-card" style="display: none;">
+			<h2>👥 Users</h2>
+			<form onsubmit="saveUser(); return false;" style="margin: 10px 0;">
+				<input id="user-name" class="btn" placeholder="Username" required>
+				<input id="user-password" class="btn" type="password" placeholder="Password" autocomplete="new-password">
+				<select id="user-role" class="btn">
+					<option value="viewer">Viewer</option>
+					<option value="operator">Operator</option>
+					<option value="admin">Admin</option>
+				</select>
+				<button class="btn" type="submit">Save User</button>
+			</form>
+			<table>
+				<thead><tr><th>User</th><th>Role</th><th>Created</th><th></th></tr></thead>
+				<tbody id="users"></tbody>
+			</table>
+		</div>
 
-type ServicesResponse struct {
-	Services []ServiceStatus `json:"services"`
-}
+		<div class="card" id="ca-card" style="display: none;">
+			<h2>📱 Device Certificates</h2>
+			<p>Client certificates for phones and the edge proxy. Give a password to get a PKCS#12 bundle phones can import;
+			the private key is not kept. <a href="/api/ca/root">CA certificate</a> · <a href="/api/ca/crl?format=pem">CRL</a></p>
+			<p id="ca-fingerprint" style="font-size: 0.85em; word-break: break-all;"></p>
+			<form onsubmit="issueCert(); return false;" style="margin: 10px 0;">
+				<input id="cert-name" class="btn" placeholder="Name, e.g. alice-phone" required>
+				<select id="cert-role" class="btn">
+					<option value="">No role (login still needed)</option>
+					<option value="viewer">Viewer</option>
+					<option value="operator">Operator</option>
+					<option value="admin">Admin</option>
+				</select>
+				<select id="cert-validity" class="btn">
+					<option value="">Default lifetime</option>
+					<option value="720h">30 days</option>
+					<option value="8760h">1 year</option>
+					<option value="17520h">2 years</option>
+				</select>
+				<input id="cert-password" class="btn" type="password" placeholder="Bundle password" autocomplete="new-password">
+				<button class="btn" type="submit">Issue Certificate</button>
+			</form>
+			<table>
+				<thead><tr><th>Name</th><th>Role</th><th>Expires</th><th>Status</th><th></th></tr></thead>
+				<tbody id="certs"></tbody>
+			</table>
+		</div>
 
-// API handlers
-func (s *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	storageOK := checkStorage(s.config.Storage.Path) == nil
+		<script>
+		const fmt = t => t && !t.startsWith('0001') ? new Date(t).toLocaleString() : 'never';
 
-	response := HealthResponse{
-		Status:  "ok",
-		Version: appVersion,
-		Storage: storageOK,
-	}
+		async function send(method, url, body) {
+			const res = await fetch(url, {
+				method: method,
+				headers: { 'Content-Type': 'application/json' },
+				body: body ? JSON.stringify(body) : undefined
+			});
+			const data = await res.json();
+			if (!res.ok) alert(data.error || 'Request failed');
+			return res.ok ? data : null;
+		}
 
-	if !storageOK {
-		response.Status = "degraded"
-		w.WriteHeader(http.StatusServiceUnavailable)
-	}
+		async function loadMe() {
+			const data = await (await fetch('/api/auth/me')).json();
+			const p = data.principal;
+			const me = document.getElementById('me');
+			if (!data.enabled) {
+				me.innerHTML = '<span class="status-warn">⚠️ Authentication is disabled; everyone has full access.</span>';
+			} else if (p.method === 'local') {
+				me.textContent = 'Local kiosk access (' + p.role + ')';
+			} else {
+				me.textContent = 'Signed in as ' + p.username + ' (' + p.role + ')';
+				document.getElementById('password-form').style.display = 'block';
+			}
+			if (p.role === 'admin') {
+				document.getElementById('users-card').style.display = 'block';
+				loadUsers();
+				loadCerts();
+			}
+		}
 
-	jsonResponse(w, response)
-}
+		// Buttons refer to rows by index, so no data ends up in inline scripts
+		let tokens = [], users = [], certs = [];
 
-func (s *APIServer) handleStorageAPI(w http.ResponseWriter, r *http.Request) {
-	available := checkStorage(s.config.Storage.Path) == nil
+		async function loadTokens() {
+			tokens = (await (await fetch('/api/auth/tokens')).json()).tokens;
+			document.getElementById('tokens').innerHTML = tokens.map((t, i) =>
+				'<tr><td>' + esc(t.name) + '</td><td>' + esc(t.username) + '</td><td>' + esc(t.role) +
+				'</td><td>' + fmt(t.last_used) + '</td><td>' +
+				'<button class="btn" onclick="revokeToken(tokens[' + i + '].id)">Revoke</button></td></tr>'
+			).join('');
+		}
 
-	response := StorageResponse{
-		Path:      s.config.Storage.Path,
-		Available: available,
-	}
+		async function createToken() {
+			const data = await send('POST', '/api/auth/tokens', {
+				name: document.getElementById('token-name').value,
+				role: document.getElementById('token-role').value,
+				expires_in: document.getElementById('token-expiry').value
+			});
+			if (data) prompt('Copy this token now; it will not be shown again', data.token);
+			loadTokens();
+		}
 
-	if available {
-		// Use the cross-platform getStorageUsage function
-		used, free, total, err := getStorageUsage(s.config.Storage.Path)
-		if err == nil {
-			response.Total = total
-			response.Free = free
-			response.Used = used
-			if response.Total > 0 {
-				response.UsedPct = float64(response.Used) / float64(response.Total) * 100
-			}
+		async function revokeToken(id) {
+			if (!confirm('Revoke this token?')) return;
+			await send('DELETE', '/api/auth/tokens?id=' + encodeURIComponent(id));
+			loadTokens();
 		}
-	}
 
-	jsonResponse(w, response)
-}
+		async function changePassword() {
+			const data = await send('POST', '/api/auth/password', {
+				current: document.getElementById('current').value,
+				password: document.getElementById('new-password').value
+			});
+			if (data) location.href = '/login';
+		}
 
-func (s *APIServer) handlePrintQueues(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement CUPS integration
-	response := map[string]interface{}{
-		"queues": []map[string]interface{}{
-			{
-				"name":  s.config.CUPS.Printer,
-				"jobs":  0,
-				"state": "idle",
-			},
-		},
-	}
+		async function loadUsers() {
+			users = (await (await fetch('/api/auth/users')).json()).users;
+			document.getElementById('users').innerHTML = users.map((u, i) =>
+				'<tr><td>' + esc(u.username) + '</td><td>' + esc(u.role) + '</td><td>' + fmt(u.created) + '</td><td>' +
+				'<button class="btn" onclick="deleteUser(users[' + i + '].username)">Delete</button></td></tr>'
+			).join('');
+		}
 
-	jsonResponse(w, response)
-}
+		async function saveUser() {
+			await send('POST', '/api/auth/users', {
+				username: document.getElementById('user-name').value,
+				password: document.getElementById('user-password').value,
+				role: document.getElementById('user-role').value
+			});
+			loadUsers();
+		}
 
-func (s *APIServer) handleServicesAPI(w http.ResponseWriter, r *http.Request) {
-	sm := NewServiceManager()
+		async function deleteUser(username) {
+			if (!confirm('Delete user ' + username + '?')) return;
+			await send('DELETE', '/api/auth/users?username=' + encodeURIComponent(username));
+			loadUsers();
+		}
 
-	// List of services to monitor
-	services := []string{
-		"cups",
-		"smbd",
-		"nmbd",
-		"saned",
-		"docker",
-	}
+		async function loadCerts() {
+			const res = await fetch('/api/ca/certs');
+			if (!res.ok) return;
+			const data = await res.json();
+			document.getElementById('ca-card').style.display = 'block';
+			document.getElementById('ca-fingerprint').textContent = 'CA SHA-256: ' + data.fingerprint;
+			certs = data.certs;
+			document.getElementById('certs').innerHTML = certs.map((c, i) => {
+				const revoked = !c.revoked.startsWith('0001');
+				const expired = new Date(c.expires) < new Date();
+				const status = revoked ? '<span class="status-error">Revoked</span>' :
+					expired ? '<span class="status-warn">Expired</span>' : '<span class="status-ok">Valid</span>';
+				return '<tr><td>' + esc(c.name) + '</td><td>' + esc(c.role || '-') + '</td><td>' + fmt(c.expires) +
+					'</td><td>' + status + '</td><td>' +
+					(revoked ? '' : '<button class="btn" onclick="revokeCert(certs[' + i + '].serial, certs[' + i + '].name)">Revoke</button>') +
+					'</td></tr>';
+			}).join('');
+		}
 
-	// Get status for all services
-	statuses := sm.GetMultipleStatuses(services)
+		function download(name, type, bytes) {
+			const a = document.createElement('a');
+			a.href = URL.createObjectURL(new Blob([bytes], { type: type }));
+			a.download = name;
+			a.click();
+			URL.revokeObjectURL(a.href);
+		}
 
-	response := ServicesResponse{
-		Services: statuses,
-	}
+		async function issueCert() {
+			const name = document.getElementById('cert-name').value;
+			const data = await send('POST', '/api/ca/certs', {
+				name: name,
+				role: document.getElementById('cert-role').value,
+				valid_for: document.getElementById('cert-validity').value,
+				password: document.getElementById('cert-password').value
+			});
+			if (data && data.p12) {
+				download(name + '.p12', 'application/x-pkcs12', Uint8Array.from(atob(data.p12), c => c.charCodeAt(0)));
+			} else if (data) {
+				download(name + '.pem', 'application/x-pem-file', data.cert_pem + data.key_pem);
+			}
+			document.getElementById('cert-password').value = '';
+			loadCerts();
+		}
 
-	jsonResponse(w, response)
+		async function revokeCert(serial, name) {
+			if (!confirm('Revoke the certificate of ' + name + '? The device will lose access.')) return;
+			await send('DELETE', '/api/ca/certs?serial=' + encodeURIComponent(serial));
+			loadCerts();
+		}
+
+		loadMe();
+		loadTokens();
+		</script>
+	`
+
+	s.renderPage(w, "Account", content)
+}
+
+// handleSettingsPage edits config.yaml with a preview of the changes
+func (s *APIServer) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>🛠️ Configuration</h2>
+			<p id="config-path">Loading...</p>
+			<p style="font-size: 0.85em; opacity: 0.8;">Changes are validated and previewed before saving. The previous file is kept
+			and restored automatically if the new one fails to load.</p>
+			<textarea id="config" spellcheck="false" style="width: 100%; height: 50vh; margin-top: 10px; padding: 10px;
+				border-radius: 10px; border: 2px solid rgba(255,255,255,0.3); background: rgba(0,0,0,0.3); color: white;
+				font-family: monospace; font-size: 0.95em;"></textarea>
+			<div style="margin-top: 10px;">
+				<button class="btn" onclick="preview()">Preview Changes</button>
+				<button class="btn" id="save" onclick="save()" disabled>Save</button>
+				<button class="btn" onclick="load()">Discard Edits</button>
+				<select id="history" class="btn"></select>
+				<button class="btn" onclick="loadVersion()">Load Version</button>
+			</div>
+			<p id="message" style="margin-top: 10px;"></p>
+			<table id="changes" style="display: none;">
+				<thead><tr><th>Setting</th><th>Current</th><th>New</th><th>Applies</th></tr></thead>
+				<tbody></tbody>
+			</table>
+		</div>
+
+		<div class="card" id="overrides-card" style="display: none;">
+			<h2>📌 Overrides</h2>
+			<p>These settings are set outside this file and take precedence over it.</p>
+			<table>
+				<thead><tr><th>Setting</th><th>Source</th></tr></thead>
+				<tbody id="overrides"></tbody>
+			</table>
+		</div>
+
+		<script>
+		let base = '';
+
+		function message(text, cls) {
+			const p = document.getElementById('message');
+			p.className = cls || '';
+			p.textContent = text;
+		}
+
+		async function send(method, url, body) {
+			const res = await fetch(url, {
+				method: method,
+				headers: { 'Content-Type': 'application/json' },
+				body: body ? JSON.stringify(body) : undefined
+			});
+			const data = await res.json();
+			if (!res.ok) message(data.error || 'Request failed', 'status-error');
+			return res.ok ? data : null;
+		}
+
+		async function load() {
+			const data = await send('GET', '/api/config');
+			if (!data) return;
+			base = data.hash;
+			document.getElementById('config-path').textContent = 'File: ' + data.path;
+			document.getElementById('config').value = data.yaml;
+			document.getElementById('history').innerHTML = '<option value="">Previous versions</option>' +
+				data.history.map(v => '<option value="' + esc(v.version) + '">' + new Date(v.saved).toLocaleString() + '</option>').join('');
+			const overrides = Object.keys(data.overrides).sort();
+			document.getElementById('overrides-card').style.display = overrides.length ? 'block' : 'none';
+			document.getElementById('overrides').innerHTML = overrides.map(k =>
+				'<tr><td>' + esc(k) + '</td><td>' + esc(data.overrides[k]) + '</td></tr>'
+			).join('');
+			document.getElementById('changes').style.display = 'none';
+			document.getElementById('save').disabled = true;
+		}
+
+		async function loadVersion() {
+			const version = document.getElementById('history').value;
+			if (!version) return;
+			const data = await send('GET', '/api/config?version=' + encodeURIComponent(version));
+			if (!data) return;
+			document.getElementById('config').value = data.yaml;
+			message('Loaded the version from ' + document.getElementById('history').selectedOptions[0].textContent + '; preview and save to restore it.');
+		}
+
+		document.getElementById('config').addEventListener('input', () => {
+			document.getElementById('save').disabled = true;
+		});
+
+		const show = v => v === null || v === undefined ? '' : typeof v === 'object' ? JSON.stringify(v) : String(v);
+
+		async function preview() {
+			const data = await send('PUT', '/api/config', { yaml: document.getElementById('config').value, preview: true });
+			const table = document.getElementById('changes');
+			if (!data) {
+				table.style.display = 'none';
+				return;
+			}
+			if (data.changes.length === 0) {
+				message('No changes to the running configuration.');
+			} else {
+				message(data.changes.length + ' setting(s) will change.', 'status-ok');
+			}
+			table.style.display = data.changes.length ? 'table' : 'none';
+			table.querySelector('tbody').innerHTML = data.changes.map(c =>
+				'<tr><td>' + esc(c.path) + '</td><td>' + esc(show(c.old)) + '</td><td>' + esc(show(c.new)) + '</td><td>' +
+				(data.restart_required.includes(c.path) ? '<span class="status-warn">After restart</span>' : 'Now') + '</td></tr>'
+			).join('');
+			document.getElementById('save').disabled = false;
+		}
+
+		async function save() {
+			if (!confirm('Save the configuration?')) return;
+			const data = await send('PUT', '/api/config', { yaml: document.getElementById('config').value, base: base });
+			if (!data) return;
+			await load();
+			if (data.restart_required.length) {
+				message('Saved. Restart ctrlsrvd to apply: ' + data.restart_required.join(', '), 'status-warn');
+			} else {
+				message('Saved and applied.', 'status-ok');
+			}
+		}
+
+		load();
+		</script>
+	`
+
+	s.renderPage(w, "Settings", content)
+}
+
+// handleLogsPage shows recent daemon logs with filters
+func (s *APIServer) handleLogsPage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>📜 Logs</h2>
+			<div style="margin-bottom: 10px;">
+				<select id="level" class="btn" onchange="load()">
+					<option value="debug">Debug</option>
+					<option value="info" selected>Info</option>
+					<option value="warn">Warning</option>
+					<option value="error">Error</option>
+				</select>
+				<select id="subsystem" class="btn" onchange="load()"><option value="">All subsystems</option></select>
+				<input type="search" id="search" placeholder="Filter..." class="btn" onchange="load()">
+				<label><input type="checkbox" id="follow" checked> Follow</label>
+			</div>
+			<table>
+				<thead><tr><th>Time</th><th>Level</th><th>Subsystem</th><th>Message</th></tr></thead>
+				<tbody id="entries"></tbody>
+			</table>
+		</div>
+
+		<script>
+		let last = 0;
+
+		const levelClass = { WARN: 'status-warn', ERROR: 'status-error' };
+
+		function row(e) {
+			const attrs = Object.keys(e.attrs).sort().map(k => esc(k) + '=' + esc(e.attrs[k])).join(' ');
+			return '<tr><td>' + new Date(e.time).toLocaleTimeString() + '</td>' +
+				'<td class="' + (levelClass[e.level] || '') + '">' + esc(e.level) + '</td>' +
+				'<td>' + esc(e.subsystem) + '</td>' +
+				'<td>' + esc(e.message) + (attrs ? '<br><small style="opacity: 0.8;">' + attrs + '</small>' : '') + '</td></tr>';
+		}
+
+		function query(after) {
+			const params = new URLSearchParams({
+				level: document.getElementById('level').value,
+				subsystem: document.getElementById('subsystem').value,
+				q: document.getElementById('search').value,
+				after: after
+			});
+			return fetch('/api/logs?' + params).then(res => res.json());
+		}
+
+		async function load() {
+			const data = await query(0);
+			const select = document.getElementById('subsystem');
+			if (select.options.length === 1) {
+				select.innerHTML += data.subsystems.map(s => '<option>' + esc(s) + '</option>').join('');
+			}
+			document.getElementById('entries').innerHTML = data.entries.reverse().map(row).join('');
+			last = data.entries.length ? data.entries[0].seq : last;
+		}
+
+		async function follow() {
+			if (!document.getElementById('follow').checked) return;
+			const data = await query(last);
+			if (!data.entries.length) return;
+			document.getElementById('entries').insertAdjacentHTML('afterbegin', data.entries.reverse().map(row).join(''));
+			last = data.entries[0].seq;
+		}
+
+		load();
+		setInterval(follow, 3000);
+		</script>
+	`
+
+	s.renderPage(w, "Logs", content)
+}
+
+// handleServicesPage shows service status
+func (s *APIServer) handleServicesPage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>⚙️ System Services</h2>
+			<table id="services-table">
+				<thead>
+					<tr>
+						<th>Service</th>
+						<th>Status</th>
+					</tr>
+				</thead>
+				<tbody>
+					<tr><td colspan="2">Loading...</td></tr>
+				</tbody>
+			</table>
+		</div>
+
+		<div class="card">
+			<h2>🌐 Edge Tunnel</h2>
+			<p id="tunnel">Loading...</p>
+		</div>
+		
+		<script>
+		function updateServices(data) {
+			const tbody = document.querySelector('#services-table tbody');
+
+			tbody.innerHTML = data.services.map(s => {
+				const status = s.active ?
+					'<span class="status-ok">✅ Active</span>' :
+					'<span class="status-error">❌ Inactive</span>';
+				return '<tr><td>' + esc(s.name) + '</td><td>' + status + '</td></tr>';
+			}).join('');
+		}
+
+		function updateTunnel(t) {
+			const el = document.getElementById('tunnel');
+			if (t.state === 'disabled') {
+				el.textContent = 'Not configured';
+				return;
+			}
+			let html = t.state === 'connected' ?
+				'<span class="status-ok">✅ Connected</span> to ' + esc(t.remote_addr) + ' from ' + esc(t.local_addr) +
+				' · ' + t.rtt_ms + ' ms · ' + t.active_streams + ' streams · ' + t.requests + ' requests' :
+				'<span class="status-warn">⚠️ ' + esc(t.state) + '</span> ' + esc(t.endpoint);
+			html += '<br>Reconnects: ' + t.reconnects + ' · Migrations: ' + t.migrations;
+			if (t.last_error) {
+				html += '<br><span class="status-error">' + esc(t.last_error) + '</span>';
+			}
+			el.innerHTML = html;
+		}
+
+		const events = new EventSource('/api/events?topics=services,tunnel');
+		events.addEventListener('services', e => updateServices(JSON.parse(e.data)));
+		events.addEventListener('tunnel', e => updateTunnel(JSON.parse(e.data)));
+		</script>
+	`
+
+	s.renderPage(w, "Services", content)
+}
+
+// handleRemovablePage shows removable drives and import progress
+func (s *APIServer) handleRemovablePage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>🔌 USB Drives</h2>
+			<table>
+				<thead>
+					<tr>
+						<th>Device</th>
+						<th>Size</th>
+						<th>Status</th>
+						<th>Actions</th>
+					</tr>
+				</thead>
+				<tbody id="devices">
+					<tr><td colspan="4">Loading...</td></tr>
+				</tbody>
+			</table>
+		</div>
+
+		<div class="card">
+			<h2>Import to Storage</h2>
+			<div id="import">No import running</div>
+		</div>
+
+		<script>
+		async function post(url, body) {
+			const res = await fetch(url, {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify(body)
+			});
+			const data = await res.json();
+			if (!res.ok) alert(data.error || 'Request failed');
+			update();
+		}
+
+		function gb(bytes) {
+			return (bytes / 1024 / 1024 / 1024).toFixed(2);
+		}
+
+		let devices = [];
+
+		async function update() {
+			try {
+				const res = await fetch('/api/removable');
+				render(await res.json());
+			} catch (e) {
+				document.getElementById('devices').innerHTML =
+					'<tr><td colspan="4" class="status-error">Failed to load</td></tr>';
+			}
+		}
+
+		function render(data) {
+			const tbody = document.getElementById('devices');
+			devices = data.devices;
+
+			if (devices.length === 0) {
+				tbody.innerHTML = '<tr><td colspan="4">No USB drives connected</td></tr>';
+			} else {
+				tbody.innerHTML = devices.map((d, i) => {
+					const name = esc(d.label || d.name) + '<br><small>' + esc(d.vendor + ' ' + d.model + ' (' + d.fstype + ')') + '</small>';
+					const dev = 'devices[' + i + '].name';
+					let status, actions = '';
+					if (d.protected) {
+						status = '<span class="status-warn">🔒 System disk</span>';
+					} else if (d.mountpoint) {
+						status = '<span class="status-ok">Mounted</span>';
+						actions = '<button class="btn" onclick="post(\'/api/removable/import\', {device: ' + dev + ', photos_only: true})">Import Photos</button>' +
+							'<button class="btn" onclick="post(\'/api/removable/import\', {device: ' + dev + '})">Copy All</button>' +
+							'<button class="btn" onclick="post(\'/api/removable/unmount\', {device: ' + dev + ', eject: true})">Eject</button>';
+					} else {
+						status = 'Not mounted';
+						actions = '<button class="btn" onclick="post(\'/api/removable/mount\', {device: ' + dev + '})">Mount</button>';
+					}
+					return '<tr><td>' + name + '</td><td>' + gb(d.size_bytes) + ' GB</td><td>' + status + '</td><td>' + actions + '</td></tr>';
+				}).join('');
+			}
+
+			const imp = data.import;
+			const div = document.getElementById('import');
+			if (!imp.started || imp.started.startsWith('0001')) {
+				div.innerHTML = 'No import running';
+			} else {
+				const pct = imp.total_bytes > 0 ? (imp.copied_bytes / imp.total_bytes * 100).toFixed(1) : '100.0';
+				let state = imp.running ? '⏳ Copying... ' + pct + '%' : '<span class="status-ok">✅ Done</span>';
+				if (imp.error) state = '<span class="status-error">❌ ' + esc(imp.error) + '</span>';
+				div.innerHTML = '<table>' +
+					'<tr><td>Destination:</td><td><code>' + esc(imp.dest) + '</code></td></tr>' +
+					'<tr><td>Status:</td><td>' + state + '</td></tr>' +
+					'<tr><td>Files:</td><td>' + (imp.copied_files + imp.skipped_files) + ' / ' + imp.total_files + '</td></tr>' +
+					'<tr><td>Data:</td><td>' + gb(imp.copied_bytes) + ' / ' + gb(imp.total_bytes) + ' GB</td></tr>' +
+					'</table>';
+			}
+		}
+
+		const events = new EventSource('/api/events?topics=removable');
+		events.addEventListener('removable', e => render(JSON.parse(e.data)));
+		</script>
+	`
+
+	s.renderPage(w, "USB Drives", content)
+}
+
+// handleSearchPage shows the file search UI
+func (s *APIServer) handleSearchPage(w http.ResponseWriter, r *http.Request) {
+	content := `
+		<div class="card">
+			<h2>🔍 Search Files</h2>
+			<form id="search-form" onsubmit="search(); return false;">
+				<input id="q" type="search" placeholder="Search names and contents..."
+					style="width: 100%; padding: 15px; font-size: 1.2em; border-radius: 10px; border: none;">
+				<div style="margin-top: 10px;">
+					<select id="type" class="btn">
+						<option value="">All types</option>
+						<option value="document">Documents</option>
+						<option value="image">Images</option>
+						<option value="video">Videos</option>
+						<option value="audio">Audio</option>
+						<option value="archive">Archives</option>
+						<option value="other">Other</option>
+					</select>
+					<input id="folder" class="btn" placeholder="Folder">
+					<input id="from" class="btn" type="date" title="Modified from">
+					<input id="to" class="btn" type="date" title="Modified until">
+					<button class="btn" type="submit">Search</button>
+				</div>
+			</form>
+			<p id="summary" style="margin-top: 15px;"></p>
+			<table>
+				<tbody id="results"></tbody>
+			</table>
+		</div>
+
+		<script>
+		function thumb(r) {
+			if (r.type !== 'image' && !r.name.toLowerCase().endsWith('.pdf')) return '';
+			return '<img loading="lazy" style="max-width: 64px; max-height: 64px; border-radius: 5px;" ' +
+				'src="/api/files/thumb?size=128&path=' + encodeURIComponent(r.path) + '" onerror="this.remove()">';
+		}
+
+		async function search() {
+			const params = new URLSearchParams();
+			for (const id of ['q', 'type', 'folder', 'from', 'to']) {
+				const value = document.getElementById(id).value;
+				if (value) params.set(id, value);
+			}
+			history.replaceState(null, '', '/search?' + params);
+
+			const res = await fetch('/api/search?' + params);
+			const data = await res.json();
+			if (!res.ok) {
+				document.getElementById('summary').textContent = data.error;
+				return;
+			}
+
+			let summary = data.total + ' results';
+			if (!data.ready) summary += ' (index still building, ' + data.indexed + ' files so far)';
+			document.getElementById('summary').textContent = summary;
+
+			document.getElementById('results').innerHTML = data.results.map(r =>
+				'<tr><td style="width: 80px;">' + thumb(r) + '</td><td><strong>' + esc(r.name) + '</strong><br><small>' + esc(r.path) + '</small>' +
+				(r.snippet ? '<br><small><em>…' + esc(r.snippet) + '…</em></small>' : '') +
+				'</td><td>' + esc(r.type) + '</td><td>' + new Date(r.mtime).toLocaleDateString() + '</td></tr>'
+			).join('');
+		}
+
+		const initial = new URLSearchParams(location.search);
+		for (const id of ['q', 'type', 'folder', 'from', 'to']) {
+			if (initial.get(id)) document.getElementById(id).value = initial.get(id);
+		}
+		if (initial.toString()) search();
+		</script>
+	`
+
+	s.renderPage(w, "Search", content)
+}
+
+// Response types
+type HealthResponse struct {
+	Status  string   `json:"status"`
+	Version string   `json:"version"`
+	Storage bool     `json:"storage_ok"`
+	Alerts  []string `json:"alerts,omitempty"`
+}
+
+type StorageResponse struct {
+	Path      string  `json:"path"`
+	Available bool    `json:"available"`
+	Used      uint64  `json:"used_bytes"`
+	Free      uint64  `json:"free_bytes"`
+	Total     uint64  `json:"total_bytes"`
+	UsedPct   float64 `json:"used_percent"`
+
+	Volumes []VolumeStatus `json:"volumes"`
+	Quotas  []QuotaUsage   `json:"quotas"`
+}
+
+type ServiceStatus struct {
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Enabled bool   `json:"enabled"`
+}
+
+type ServicesResponse struct {
+	Services []ServiceStatus `json:"services"`
+}
+
+// API handlers
+func (s *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	response := s.health()
+	if !response.Storage {
+		jsonStatus(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	jsonResponse(w, response)
+}
+
+// health checks storage and collects alerts from the subsystems
+func (s *APIServer) health() HealthResponse {
+	response := HealthResponse{
+		Status:  "ok",
+		Version: appVersion,
+		Storage: true,
+	}
+
+	// Only mandatory volumes degrade health; optional ones raise an alert
+	for _, v := range s.config.Load().Storage.Volumes {
+		if checkStorage(v.Path) == nil {
+			continue
+		}
+		if v.Mandatory {
+			response.Storage = false
+		} else {
+			response.Alerts = append(response.Alerts, "Volume unavailable: "+v.Name)
+		}
+	}
+
+	if backup := s.backups.Status(); backup.LastError != "" {
+		response.Alerts = append(response.Alerts, "Backup failed: "+backup.LastError)
+	}
+	if scrub := s.scrub.Status(); len(scrub.Mismatches) > 0 {
+		response.Alerts = append(response.Alerts, fmt.Sprintf("Scrub found %d corrupted files", len(scrub.Mismatches)))
+	}
+	response.Alerts = append(response.Alerts, s.quotas.Alerts()...)
+	response.Alerts = append(response.Alerts, s.tunnel.Alerts()...)
+	response.Alerts = append(response.Alerts, s.audit.Alerts()...)
+
+	if !response.Storage {
+		response.Status = "degraded"
+	}
+	return response
+}
+
+func (s *APIServer) handleStorageAPI(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.storageStatus())
+}
+
+// storageStatus reports usage of every volume and quota share
+func (s *APIServer) storageStatus() StorageResponse {
+	cfg := s.config.Load()
+	response := StorageResponse{
+		Path:    cfg.Storage.Path,
+		Volumes: checkVolumes(cfg.Storage.Volumes),
+		Quotas:  s.quotas.Usage(),
+	}
+
+	// Top-level fields describe the primary volume for older clients
+	for _, v := range response.Volumes {
+		if v.Role == VolumeRolePrimary {
+			response.Available = v.Available
+			response.Used = v.Used
+			response.Free = v.Free
+			response.Total = v.Total
+			response.UsedPct = v.UsedPct
+		}
+	}
+	return response
+}
+
+func (s *APIServer) handlePrintQueues(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.printQueues())
+}
+
+// printQueues reports the state of the print queues
+func (s *APIServer) printQueues() map[string]interface{} {
+	// TODO: Implement CUPS integration
+	response := map[string]interface{}{
+		"queues": []map[string]interface{}{
+			{
+				"name":  s.config.Load().CUPS.Printer,
+				"jobs":  0,
+				"state": "idle",
+			},
+		},
+	}
+	return response
+}
+
+func (s *APIServer) handleServicesAPI(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, servicesStatus())
+}
+
+// servicesStatus reports the state of the monitored system services
+func servicesStatus() ServicesResponse {
+	sm := NewServiceManager()
+
+	// List of services to monitor
+	services := []string{
+		"cups",
+		"smbd",
+		"nmbd",
+		"saned",
+		"docker",
+	}
+
+	// Get status for all services
+	statuses := sm.GetMultipleStatuses(services)
+
+	return ServicesResponse{
+		Services: statuses,
+	}
+}
+
+type BackupResponse struct {
+	Status    BackupStatus     `json:"status"`
+	Snapshots []BackupSnapshot `json:"snapshots"`
+}
+
+type BackupRestoreRequest struct {
+	Snapshot string `json:"snapshot"`
+	Path     string `json:"path"`
+	Dest     string `json:"dest"`
+}
+
+func (s *APIServer) handleBackupAPI(w http.ResponseWriter, r *http.Request) {
+	response := BackupResponse{
+		Status:    s.backups.Status(),
+		Snapshots: []BackupSnapshot{},
+	}
+	if s.config.Load().Backup.Enabled {
+		if snaps, err := s.backups.Snapshots(); err == nil {
+			response.Snapshots = snaps
+		}
+	}
+
+	jsonResponse(w, response)
+}
+
+// startBackupOperation runs a long backup operation in the background.
+// Progress and failures are reported through the backup status.
+func (s *APIServer) startBackupOperation(w http.ResponseWriter, r *http.Request, op func(ctx context.Context) error) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.config.Load().Backup.Enabled {
+		jsonError(w, http.StatusConflict, "backups are not enabled")
+		return
+	}
+	if s.backups.Status().Operation != "" {
+		jsonError(w, http.StatusConflict, errBackupBusy.Error())
+		return
+	}
+
+	s.goTask(func(ctx context.Context) {
+		if err := op(ctx); err != nil {
+			backupLog.ErrorContext(r.Context(), "Backup operation failed", "error", err)
+		}
+	})
+
+	jsonStatus(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+func (s *APIServer) handleBackupRun(w http.ResponseWriter, r *http.Request) {
+	s.startBackupOperation(w, r, func(ctx context.Context) error {
+		_, err := s.backups.Backup(ctx)
+		return err
+	})
+}
+
+func (s *APIServer) handleBackupVerify(w http.ResponseWriter, r *http.Request) {
+	s.startBackupOperation(w, r, func(ctx context.Context) error {
+		_, err := s.backups.Verify(ctx)
+		return err
+	})
+}
+
+func (s *APIServer) handleBackupPrune(w http.ResponseWriter, r *http.Request) {
+	if c := s.config.Load().Backup; r.Method == http.MethodPost && c.Enabled && c.KeepLast <= 0 && c.KeepDaily <= 0 {
+		jsonError(w, http.StatusConflict, errNoRetention.Error())
+		return
+	}
+	s.startBackupOperation(w, r, func(ctx context.Context) error {
+		_, err := s.backups.Prune(ctx)
+		return err
+	})
+}
+
+func (s *APIServer) handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	var req BackupRestoreRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Snapshot == "" {
+			jsonError(w, http.StatusBadRequest, "snapshot is required")
+			return
+		}
+	}
+
+	s.startBackupOperation(w, r, func(ctx context.Context) error {
+		_, err := s.backups.Restore(ctx, req.Snapshot, req.Path, req.Dest)
+		return err
+	})
+}
+
+// handleScrubAPI reports scrub results (GET) or starts a scrub pass (POST)
+func (s *APIServer) handleScrubAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.scrub.Status())
+	case http.MethodPost:
+		if !s.config.Load().Scrub.Enabled {
+			jsonError(w, http.StatusConflict, "scrubbing is not enabled")
+			return
+		}
+		if s.scrub.Status().Running {
+			jsonError(w, http.StatusConflict, "scrub already running")
+			return
+		}
+		s.goTask(func(ctx context.Context) {
+			if err := s.scrub.Scrub(ctx); err != nil {
+				storageLog.ErrorContext(r.Context(), "Scrub failed", "error", err)
+			}
+		})
+		jsonStatus(w, http.StatusAccepted, map[string]string{"status": "started"})
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleScrubAccept marks the current content of a mismatched file as good
+func (s *APIServer) handleScrubAccept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		jsonError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	if err := s.scrub.Accept(req.Path); err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	jsonResponse(w, s.scrub.Status())
+}
+
+// DuplicateScanRequest starts a duplicate scan
+type DuplicateScanRequest struct {
+	Path    string `json:"path"`
+	MinSize int64  `json:"min_size"`
+}
+
+// DuplicateApplyRequest keeps one file of a group and acts on the others
+type DuplicateApplyRequest struct {
+	Action string   `json:"action"`
+	Keep   string   `json:"keep"`
+	Remove []string `json:"remove"`
+}
+
+// handleDuplicatesAPI reports duplicate groups (GET) or starts a scan (POST)
+func (s *APIServer) handleDuplicatesAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.dupes.Status())
+	case http.MethodPost:
+		var req DuplicateScanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		if err := s.dupes.Start(s.ctx, req.Path, req.MinSize); err != nil {
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+		jsonStatus(w, http.StatusAccepted, map[string]string{"status": "started"})
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleDuplicatesApply moves duplicates to the trash or replaces them with hardlinks
+func (s *APIServer) handleDuplicatesApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req DuplicateApplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Keep == "" || len(req.Remove) == 0 {
+		jsonError(w, http.StatusBadRequest, "keep and remove are required")
+		return
+	}
+	result, err := s.dupes.Apply(r.Context(), req.Action, req.Keep, req.Remove)
+	if err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	jsonResponse(w, result)
+}
+
+type RemovableResponse struct {
+	Devices []RemovableDevice `json:"devices"`
+	Import  ImportStatus      `json:"import"`
+}
+
+type RemovableRequest struct {
+	Device     string `json:"device"`
+	Eject      bool   `json:"eject"`
+	PhotosOnly bool   `json:"photos_only"`
+}
+
+func (s *APIServer) handleRemovableAPI(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.removableStatus())
+}
+
+// removableStatus reports connected drives and import progress
+func (s *APIServer) removableStatus() RemovableResponse {
+	return RemovableResponse{
+		Devices: s.removable.Devices(),
+		Import:  s.removable.ImportStatus(),
+	}
+}
+
+// decodeRemovableRequest parses a POST body naming a device
+func decodeRemovableRequest(w http.ResponseWriter, r *http.Request) (RemovableRequest, bool) {
+	var req RemovableRequest
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Device == "" {
+		jsonError(w, http.StatusBadRequest, "device is required")
+		return req, false
+	}
+	return req, true
+}
+
+func (s *APIServer) handleRemovableMount(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRemovableRequest(w, r)
+	if !ok {
+		return
+	}
+	target, err := s.removable.Mount(req.Device)
+	if err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	jsonResponse(w, map[string]string{"mountpoint": target})
+}
+
+func (s *APIServer) handleRemovableUnmount(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRemovableRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := s.removable.Unmount(req.Device, req.Eject); err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+func (s *APIServer) handleRemovableImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		s.removable.CancelImport()
+		jsonResponse(w, s.removable.ImportStatus())
+		return
+	}
+
+	req, ok := decodeRemovableRequest(w, r)
+	if !ok {
+		return
+	}
+	dest, err := s.removable.StartImport(s.ctx, req.Device, req.PhotosOnly)
+	if err != nil {
+		jsonError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	jsonStatus(w, http.StatusAccepted, map[string]string{"status": "started", "dest": dest})
+}
+
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+	Indexed int            `json:"indexed"`
+	Ready   bool           `json:"ready"`
+}
+
+// handleSearchAPI searches the storage index.
+// Parameters: q, type, folder, from and to (YYYY-MM-DD), limit.
+func (s *APIServer) handleSearchAPI(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Load().Search.Enabled {
+		jsonError(w, http.StatusServiceUnavailable, "search is not enabled")
+		return
+	}
+
+	params := r.URL.Query()
+	query := SearchQuery{
+		Text:   params.Get("q"),
+		Type:   params.Get("type"),
+		Folder: params.Get("folder"),
+	}
+	for name, dst := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if v := params.Get(name); v != "" {
+			t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, "invalid "+name+" date, expected YYYY-MM-DD")
+				return
+			}
+			*dst = t
+		}
+	}
+	if !query.To.IsZero() {
+		// The "to" date is inclusive
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		query.Limit = limit
+	}
+
+	results, total := s.search.Search(query)
+	indexed, ready, _ := s.search.Stats()
+
+	jsonResponse(w, SearchResponse{
+		Query:   query.Text,
+		Total:   total,
+		Results: results,
+		Indexed: indexed,
+		Ready:   ready,
+	})
+}
+
+// handleUpload stores the request body at ?path= (relative to storage).
+// Existing files are only replaced with ?overwrite=true. Uploads that
+// would take a share past its hard quota are refused; the space is
+// reserved before the file is put in place.
+func (s *APIServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rel := cleanStorageRel(r.URL.Query().Get("path"))
+	dest, err := resolveUserPath(s.config.Load(), rel)
+	if err != nil || rel == "" {
+		jsonError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	var existing int64
+	if info, err := os.Stat(dest); err == nil {
+		if info.IsDir() || r.URL.Query().Get("overwrite") != "true" {
+			jsonError(w, http.StatusConflict, "file already exists")
+			return
+		}
+		existing = info.Size()
+	}
+	if r.ContentLength > 0 {
+		if err := s.quotas.Check(rel, r.ContentLength-existing); err != nil {
+			jsonError(w, http.StatusInsufficientStorage, err.Error())
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// Without a Content-Length the limit is enforced while streaming
+	var body io.Reader = r.Body
+	remaining := s.quotas.Remaining(rel)
+	if remaining >= 0 {
+		body = io.LimitReader(r.Body, remaining+existing+1)
+	}
+	n, err := io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "upload failed: "+err.Error())
+		return
+	}
+	if remaining >= 0 && n > remaining+existing {
+		jsonError(w, http.StatusInsufficientStorage, errQuotaExceeded.Error())
+		return
+	}
+	// Other uploads may have used the space meanwhile
+	if err := s.quotas.Reserve(rel, n-existing); err != nil {
+		jsonError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		s.quotas.Add(rel, existing-n)
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	os.Chmod(dest, 0644)
+
+	httpLog.InfoContext(r.Context(), "Uploaded file", "path", rel, "size", formatBytes(uint64(n)))
+	jsonStatus(w, http.StatusCreated, map[string]interface{}{"path": rel, "size": n})
+}
+
+// handleArchive streams the folder at ?path= as a ZIP (default) or tar.gz
+// (?format=tar.gz). ?include= and ?exclude= take comma-separated globs and
+// may be repeated; ?preview=true returns the file count and size instead.
+func (s *APIServer) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	rel := cleanStorageRel(q.Get("path"))
+	root, err := resolveUserPath(s.config.Load(), rel)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		jsonError(w, http.StatusNotFound, "folder not found")
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = ArchiveFormatZip
+	}
+	if format != ArchiveFormatZip && format != ArchiveFormatTarGz {
+		jsonError(w, http.StatusBadRequest, "format must be zip or tar.gz")
+		return
+	}
+
+	var filter ArchiveFilter
+	for _, key := range []string{"include", "exclude"} {
+		var patterns []string
+		for _, v := range q[key] {
+			for _, p := range strings.Split(v, ",") {
+				if p = strings.TrimSpace(p); p == "" {
+					continue
+				}
+				if _, err := path.Match(p, ""); err != nil {
+					jsonError(w, http.StatusBadRequest, "invalid pattern: "+p)
+					return
+				}
+				patterns = append(patterns, p)
+			}
+		}
+		if key == "include" {
+			filter.Include = patterns
+		} else {
+			filter.Exclude = patterns
+		}
+	}
+
+	if q.Get("preview") == "true" {
+		preview, err := previewArchive(r.Context(), root, filter)
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		preview.Path = rel
+		jsonResponse(w, preview)
+		return
+	}
+
+	name := path.Base("/" + rel)
+	if rel == "" {
+		name = "storage"
+	}
+	contentType := "application/zip"
+	if format == ArchiveFormatTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+
+	if err := writeArchive(r.Context(), w, root, format, name, filter); err != nil {
+		// Headers are already sent; abort so the client sees a broken
+		// download rather than a silently truncated archive
+		httpLog.WarnContext(r.Context(), "Archive failed", "path", root, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// handleThumbnail serves a cached JPEG preview of ?path= (relative to
+// storage), optionally bounded by ?size= pixels
+func (s *APIServer) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Load().Thumbnails.Enabled {
+		jsonError(w, http.StatusServiceUnavailable, "thumbnails are not enabled")
+		return
+	}
+	rel := r.URL.Query().Get("path")
+	if rel == "" {
+		jsonError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	if _, err := resolveUserPath(s.config.Load(), rel); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	size := 256
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			jsonError(w, http.StatusBadRequest, "invalid size")
+			return
+		}
+		size = n
+	}
+
+	path, etag, err := s.thumbs.Thumbnail(r.Context(), rel, size)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		jsonError(w, http.StatusNotFound, "file not found")
+		return
+	case errors.Is(err, errNoThumbnail):
+		jsonError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	case err != nil:
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// ServeContent answers If-None-Match with 304 using this ETag
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+type ShareCreateRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    string `json:"expires_in"`
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+type ShareResponse struct {
+	ShareInfo
+	URL string `json:"url"`
+}
+
+type SharesResponse struct {
+	Shares []ShareResponse `json:"shares"`
+}
+
+// shareURL builds the public URL for a share token
+func (s *APIServer) shareURL(r *http.Request, token string) string {
+	base := strings.TrimSuffix(s.config.Load().Shares.PublicURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + "/s/" + token
+}
+
+// handleSharesAPI lists (GET), creates (POST) and revokes (DELETE ?id=) share links
+func (s *APIServer) handleSharesAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.shares.List()
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		response := SharesResponse{Shares: make([]ShareResponse, 0, len(list))}
+		for _, sh := range list {
+			response.Shares = append(response.Shares, ShareResponse{ShareInfo: sh, URL: s.shareURL(r, sh.Token)})
+		}
+		jsonResponse(w, response)
+
+	case http.MethodPost:
+		var req ShareCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			jsonError(w, http.StatusBadRequest, "path is required")
+			return
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				jsonError(w, http.StatusBadRequest, "invalid expires_in duration")
+				return
+			}
+			ttl = d
+		}
+		sh, err := s.shares.Create(req.Path, ttl, req.Password, req.MaxDownloads)
+		if errors.Is(err, fs.ErrNotExist) {
+			jsonError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		jsonStatus(w, http.StatusCreated, ShareResponse{ShareInfo: sh, URL: s.shareURL(r, sh.Token)})
+
+	case http.MethodDelete:
+		if err := s.shares.Revoke(r.URL.Query().Get("id")); err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "revoked"})
+
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleShareLink serves /s/{token} and, for folder shares, /s/{token}/{path}
+func (s *APIServer) handleShareLink(w http.ResponseWriter, r *http.Request) {
+	token, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+
+	sh, err := s.shares.Resolve(token)
+	if err != nil {
+		status := http.StatusNotFound
+		if !errors.Is(err, errShareNotFound) {
+			status = http.StatusGone
+		}
+		renderMinimalPage(w, status, "Link unavailable", "<p>"+html.EscapeString(err.Error())+"</p>")
+		return
+	}
+
+	// Password-protected shares set a cookie once unlocked
+	cookieName := "share_" + sh.ID
+	if sh.PasswordHash != "" {
+		unlocked := false
+		if c, err := r.Cookie(cookieName); err == nil {
+			unlocked = hmac.Equal([]byte(c.Value), []byte(s.shares.UnlockCookie(sh)))
+		}
+		client := throttleKey(r)
+		if wait := s.logins.Wait(client); !unlocked && r.Method == http.MethodPost && wait > 0 {
+			authLog.WarnContext(r.Context(), "Share password throttled", "share", sh.ID, "remote", r.RemoteAddr, "wait", wait.Round(time.Second))
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+			renderMinimalPage(w, http.StatusTooManyRequests, "Password required", "<p>Too many failed attempts, try again later</p>")
+			return
+		}
+		if !unlocked && r.Method == http.MethodPost {
+			if s.shares.CheckPassword(sh, r.PostFormValue("password")) {
+				s.logins.Succeed(client)
+				http.SetCookie(w, &http.Cookie{
+					Name:     cookieName,
+					Value:    s.shares.UnlockCookie(sh),
+					Path:     "/s/" + token,
+					Expires:  sh.Expires,
+					HttpOnly: true,
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteStrictMode,
+				})
+				http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+				return
+			}
+			s.logins.Fail(client)
+			authLog.WarnContext(r.Context(), "Wrong password for share", "share", sh.ID, "remote", r.RemoteAddr)
+		}
+		if !unlocked {
+			renderMinimalPage(w, http.StatusUnauthorized, "Password required", `
+				<form method="post">
+					<input type="password" name="password" placeholder="Password" autofocus>
+					<button type="submit">Open</button>
+				</form>`)
+			return
+		}
+	}
+
+	cfg := s.config.Load()
+	root, err := resolveUserPath(cfg, sh.Path)
+	if err != nil || sh.Path == "" {
+		renderMinimalPage(w, http.StatusNotFound, "Link unavailable", "<p>File not found</p>")
+		return
+	}
+	target := root
+	if sub != "" {
+		if !sh.IsDir {
+			http.NotFound(w, r)
+			return
+		}
+		// The listing hides dotfiles; requests for them are refused too
+		if isHiddenRel(sub) {
+			http.NotFound(w, r)
+			return
+		}
+		if target, err = resolveStoragePath(root, sub); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Links inside a shared folder must not lead out of it
+		if err := checkNoSymlinks(cfg.Storage.Path, target); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil || (!info.IsDir() && !info.Mode().IsRegular()) {
+		renderMinimalPage(w, http.StatusNotFound, "Link unavailable", "<p>File not found</p>")
+		return
+	}
+
+	if info.IsDir() {
+		s.renderShareListing(w, r, token, sh, target, sub)
+		return
+	}
+
+	f, err := openNoFollow(target)
+	if err != nil {
+		renderMinimalPage(w, http.StatusNotFound, "Link unavailable", "<p>File not found</p>")
+		return
+	}
+	defer f.Close()
+
+	// Range requests resume the same download and are not counted again
+	if r.Header.Get("Range") == "" {
+		s.shares.CountDownload(sh.ID)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// renderShareListing lists the contents of a shared folder
+func (s *APIServer) renderShareListing(w http.ResponseWriter, r *http.Request, token string, sh Share, dir, sub string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		renderMinimalPage(w, http.StatusInternalServerError, "Error", "<p>Cannot read folder</p>")
+		return
+	}
+
+	base := "/s/" + token + "/"
+	if sub != "" {
+		base += strings.TrimSuffix(sub, "/") + "/"
+	}
+
+	var b strings.Builder
+	b.WriteString("<ul>")
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || (!e.IsDir() && !e.Type().IsRegular()) {
+			continue
+		}
+		name := e.Name()
+		href := base + url.PathEscape(name)
+		label := html.EscapeString(name)
+		if e.IsDir() {
+			href += "/"
+			label = "📁 " + label
+		}
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(href), label)
+	}
+	b.WriteString("</ul>")
+
+	renderMinimalPage(w, http.StatusOK, html.EscapeString(filepath.Base(dir)), b.String())
+}
+
+// renderMinimalPage renders a standalone page without the navigation, for
+// share link visitors and the login page
+func renderMinimalPage(w http.ResponseWriter, status int, title, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+    <title>%s - ctrlsrv</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 700px; margin: 40px auto; padding: 0 20px; }
+        li { margin: 8px 0; }
+        input, button { font-size: 1.1em; padding: 8px; }
+    </style>
+</head>
+<body>
+    <h1>%s</h1>
+    %s
+</body>
+</html>`, title, title, body)
+}
+
+// handleLogin shows the login form (GET) or starts a session (POST)
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	// Only redirect within this site
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	if !s.config.Load().Auth.Enabled {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	status, message := http.StatusOK, ""
+	client := throttleKey(r)
+	if wait := s.logins.Wait(client); r.Method == http.MethodPost && wait > 0 {
+		authLog.WarnContext(r.Context(), "Login throttled", "remote", r.RemoteAddr, "client", client, "wait", wait.Round(time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+		status, message = http.StatusTooManyRequests, "<p>Too many failed attempts, try again later</p>"
+	} else if r.Method == http.MethodPost {
+		username := r.PostFormValue("username")
+		secret, expires, err := s.auth.Login(username, r.PostFormValue("password"))
+		if err == nil {
+			s.logins.Succeed(client)
+			noteAuditPrincipal(r.Context(), Principal{Username: username, Method: "password"})
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    secret,
+				Path:     "/",
+				Expires:  expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			s.logins.Fail(client)
+		}
+		authLog.WarnContext(r.Context(), "Failed login", "user", username, "remote", r.RemoteAddr, "error", err)
+		status, message = http.StatusUnauthorized, "<p>"+html.EscapeString(err.Error())+"</p>"
+	}
+
+	renderMinimalPage(w, status, "Sign in to ctrlsrv", message+`
+		<form method="post" action="/login">
+			<input type="hidden" name="next" value="`+html.EscapeString(next)+`">
+			<p><input name="username" placeholder="Username" autocomplete="username" autofocus></p>
+			<p><input type="password" name="password" placeholder="Password" autocomplete="current-password"></p>
+			<p><button type="submit">Sign in</button></p>
+		</form>`)
+}
+
+// handleLogout ends the current session
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := s.auth.Logout(c.Value); err != nil {
+			authLog.ErrorContext(r.Context(), "Logout failed", "error", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// currentPrincipal returns the caller, or an admin stand-in when
+// authentication is disabled
+func (s *APIServer) currentPrincipal(r *http.Request) Principal {
+	if p, ok := principalFrom(r); ok {
+		return p
+	}
+	return Principal{Username: "local", Role: RoleAdmin, Method: "none"}
+}
+
+// handleAuthMe returns the authenticated caller
+func (s *APIServer) handleAuthMe(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, map[string]interface{}{
+		"enabled":   s.config.Load().Auth.Enabled,
+		"principal": s.currentPrincipal(r),
+	})
+}
+
+// handleAuthPassword changes the caller's password
+func (s *APIServer) handleAuthPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p := s.currentPrincipal(r)
+	if p.Method != "session" && p.Method != "token" {
+		jsonError(w, http.StatusBadRequest, "no user account")
+		return
+	}
+	var req struct {
+		Current  string `json:"current"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if err := s.auth.ChangePassword(p.Username, req.Current, req.Password); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// TokenRequest creates an API token
+type TokenRequest struct {
+	Name      string `json:"name"`
+	Role      Role   `json:"role"`
+	ExpiresIn string `json:"expires_in"`
+}
+
+// handleAuthTokens lists (GET), creates (POST) or revokes (DELETE ?id=)
+// API tokens. Admins see everyone's tokens; others only their own.
+func (s *APIServer) handleAuthTokens(w http.ResponseWriter, r *http.Request) {
+	p := s.currentPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		owner := p.Username
+		if p.Role.Allows(RoleAdmin) {
+			owner = ""
+		}
+		tokens, err := s.auth.Tokens(owner)
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]interface{}{"tokens": tokens})
+
+	case http.MethodPost:
+		if p.Method != "session" && p.Method != "token" {
+			jsonError(w, http.StatusBadRequest, "tokens need a user account")
+			return
+		}
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			jsonError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if req.Role == "" {
+			req.Role = p.Role
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				jsonError(w, http.StatusBadRequest, "invalid expires_in")
+				return
+			}
+			ttl = d
+		}
+		token, info, err := s.auth.CreateToken(p, req.Name, req.Role, ttl)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		jsonStatus(w, http.StatusCreated, map[string]interface{}{"token": token, "info": info})
+
+	case http.MethodDelete:
+		if err := s.auth.RevokeToken(p, r.URL.Query().Get("id")); err != nil {
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "revoked"})
+
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// UserRequest creates or updates a user
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+}
+
+// handleAuthUsers lists (GET), saves (POST) or deletes (DELETE ?username=) users
+func (s *APIServer) handleAuthUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := s.auth.Users()
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]interface{}{"users": users})
+
+	case http.MethodPost:
+		var req UserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		if err := s.auth.SetUser(req.Username, req.Password, req.Role); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "saved"})
+
+	case http.MethodDelete:
+		err := s.auth.DeleteUser(r.URL.Query().Get("username"))
+		switch {
+		case errors.Is(err, errUserNotFound):
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "deleted"})
+
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleTunnelAPI returns the status of the reverse tunnel to the edge
+func (s *APIServer) handleTunnelAPI(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.tunnel.Status())
+}
+
+// handleTunnelMigrate moves the tunnel to a new path, e.g. after
+// switching uplinks
+func (s *APIServer) handleTunnelMigrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.tunnel.Status().State != TunnelConnected {
+		jsonError(w, http.StatusConflict, "tunnel is not connected")
+		return
+	}
+	s.tunnel.Migrate()
+	jsonStatus(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+// handleConfigReload re-reads the config file, like SIGHUP, and reports
+// which changes were applied and which need a restart
+func (s *APIServer) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	result, err := s.ReloadConfig()
+	if err != nil {
+		configLog.ErrorContext(r.Context(), "Config reload failed", "error", err)
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	jsonResponse(w, result)
+}
+
+// LogsResponse lists recent log entries, oldest first
+type LogsResponse struct {
+	Entries    []LogEntry `json:"entries"`
+	Subsystems []string   `json:"subsystems"`
+}
+
+// handleLogsAPI returns entries from the in-memory log buffer. ?level=,
+// ?subsystem= and ?q= filter them, ?after= returns only entries newer
+// than a sequence number and ?limit= caps the count (default 500).
+func (s *APIServer) handleLogsAPI(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := LogFilter{
+		Level:     slog.LevelInfo,
+		Subsystem: params.Get("subsystem"),
+		Search:    params.Get("q"),
+		Limit:     500,
+	}
+	if v := params.Get("level"); v != "" {
+		level, err := parseLogLevel(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter.Level = level
+	}
+	if v := params.Get("after"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid after")
+			return
+		}
+		filter.After = after
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	jsonResponse(w, LogsResponse{Entries: recentLogs(filter), Subsystems: logSubsystems})
+}
+
+// handleAuditAPI returns audit log entries, newest first, and whether the
+// hash chain verifies. ?user=, ?ip= and ?result= match exactly, ?action=
+// and ?target= match substrings, ?from= and ?to= take YYYY-MM-DD dates
+// and ?limit= caps the count (default 200).
+func (s *APIServer) handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := AuditFilter{
+		User:     params.Get("user"),
+		SourceIP: params.Get("ip"),
+		Action:   params.Get("action"),
+		Target:   params.Get("target"),
+		Result:   params.Get("result"),
+		Limit:    200,
+	}
+	for name, dst := range map[string]*time.Time{"from": &filter.Since, "to": &filter.Until} {
+		if v := params.Get(name); v != "" {
+			t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, "invalid "+name+" date, expected YYYY-MM-DD")
+				return
+			}
+			*dst = t
+		}
+	}
+	if !filter.Until.IsZero() {
+		// The "to" date is inclusive
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	result, err := s.audit.Query(filter)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonResponse(w, result)
+}
+
+// ConfigUpdateRequest replaces the config file, or with Preview only
+// validates it and lists the changes. Base is the hash of the file the
+// edit started from.
+type ConfigUpdateRequest struct {
+	YAML    string `json:"yaml"`
+	Base    string `json:"base"`
+	Preview bool   `json:"preview"`
+}
+
+// handleConfigAPI returns the config file (GET, or a saved version with
+// ?version=) or replaces it (PUT)
+func (s *APIServer) handleConfigAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if version := r.URL.Query().Get("version"); version != "" {
+			data, err := s.ConfigFileVersion(version)
+			switch {
+			case errors.Is(err, errConfigVersion):
+				jsonError(w, http.StatusNotFound, err.Error())
+				return
+			case err != nil:
+				jsonError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			jsonResponse(w, map[string]string{"version": version, "yaml": string(data)})
+			return
+		}
+		file, err := s.ConfigFile()
+		if err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonResponse(w, file)
+
+	case http.MethodPut:
+		var req ConfigUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		if req.Preview {
+			preview, err := s.PreviewConfig([]byte(req.YAML))
+			if err != nil {
+				jsonError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			jsonResponse(w, preview)
+			return
+		}
+		ip, forwarded := clientIPFrom(r)
+		result, err := s.ApplyConfig([]byte(req.YAML), req.Base, ip, forwarded, r.URL.Path)
+		switch {
+		case errors.Is(err, errConfigConflict):
+			jsonError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, errConfigInvalid):
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		case err != nil:
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonResponse(w, result)
+
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleCARoot publishes the internal CA certificate as PEM, or DER with
+// ?format=der for devices that only import that
+func (s *APIServer) handleCARoot(w http.ResponseWriter, r *http.Request) {
+	if s.ca == nil {
+		jsonError(w, http.StatusNotFound, "internal CA is disabled")
+		return
+	}
+	if r.URL.Query().Get("format") == "der" {
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", `attachment; filename="ctrlsrv-ca.crt"`)
+		w.Write(s.ca.Root().Raw)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="ctrlsrv-ca.pem"`)
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Root().Raw})
+}
+
+// handleCACRL publishes the internal CA's revocation list as DER, or PEM
+// with ?format=pem
+func (s *APIServer) handleCACRL(w http.ResponseWriter, r *http.Request) {
+	if s.ca == nil {
+		jsonError(w, http.StatusNotFound, "internal CA is disabled")
+		return
+	}
+	crl, err := s.ca.CRL()
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.URL.Query().Get("format") == "pem" {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "X509 CRL", Bytes: crl})
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// CertIssueRequest issues a client certificate
+type CertIssueRequest struct {
+	Name     string `json:"name"`
+	Role     Role   `json:"role"`
+	ValidFor string `json:"valid_for"`
+	Password string `json:"password"`
+}
+
+// handleCACerts lists (GET), issues (POST) or revokes (DELETE ?serial=)
+// client certificates of the internal CA
+func (s *APIServer) handleCACerts(w http.ResponseWriter, r *http.Request) {
+	if s.ca == nil {
+		jsonError(w, http.StatusNotFound, "internal CA is disabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, map[string]interface{}{
+			"certs":       s.ca.List(),
+			"fingerprint": certFingerprint(s.ca.Root()),
+		})
+
+	case http.MethodPost:
+		var req CertIssueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			jsonError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		var validity time.Duration
+		if req.ValidFor != "" {
+			d, err := time.ParseDuration(req.ValidFor)
+			if err != nil || d <= 0 {
+				jsonError(w, http.StatusBadRequest, "invalid valid_for")
+				return
+			}
+			validity = d
+		}
+		bundle, err := s.ca.Issue(req.Name, req.Role, validity, req.Password)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		jsonStatus(w, http.StatusCreated, bundle)
+
+	case http.MethodDelete:
+		err := s.ca.Revoke(r.URL.Query().Get("serial"))
+		switch {
+		case errors.Is(err, errCertNotFound):
+			jsonError(w, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "revoked"})
+
+	default:
+		jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
 }
 
 func jsonResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
+		httpLog.Warn("Error encoding JSON response", "error", err)
+	}
+}
+
+// jsonStatus writes a JSON response with a non-200 status code
+func jsonStatus(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		httpLog.Warn("Error encoding JSON response", "error", err)
 	}
 }
+
+func jsonError(w http.ResponseWriter, status int, message string) {
+	jsonStatus(w, status, map[string]string{"error": message})
+}
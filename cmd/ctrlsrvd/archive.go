@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats
+const (
+	ArchiveFormatZip   = "zip"
+	ArchiveFormatTarGz = "tar.gz"
+)
+
+// archiveStoredExtensions are already compressed, so ZIP stores them as-is
+// instead of spending CPU on deflating them again
+var archiveStoredExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".heic": true, ".webp": true,
+	".mp4": true, ".mov": true, ".mkv": true, ".mp3": true, ".m4a": true, ".ogg": true,
+	".zip": true, ".gz": true, ".bz2": true, ".xz": true, ".7z": true, ".rar": true,
+}
+
+// ArchiveFilter selects which files go into an archive. Patterns use
+// path.Match syntax and are tried against both the file name and its path
+// relative to the archived folder; excludes win over includes.
+type ArchiveFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// ArchivePreview summarizes what an archive would contain
+type ArchivePreview struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// archiveFile is a file selected for an archive
+type archiveFile struct {
+	path string
+	rel  string
+	info fs.FileInfo
+}
+
+// matchAny reports whether rel or its base name matches one of patterns
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether a file at rel belongs in the archive
+func (f ArchiveFilter) Matches(rel string) bool {
+	if matchAny(f.Exclude, rel) {
+		return false
+	}
+	return len(f.Include) == 0 || matchAny(f.Include, rel)
+}
+
+// walkArchive calls fn for every file below root selected by filter.
+// Hidden files and ctrlsrv state are never included.
+func walkArchive(ctx context.Context, root string, filter ArchiveFilter, fn func(archiveFile) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if !filter.Matches(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(archiveFile{path: p, rel: rel, info: info})
+	})
+}
+
+// previewArchive counts the files and bytes an archive of root would contain
+func previewArchive(ctx context.Context, root string, filter ArchiveFilter) (ArchivePreview, error) {
+	var preview ArchivePreview
+	err := walkArchive(ctx, root, filter, func(f archiveFile) error {
+		preview.Files++
+		preview.Bytes += uint64(f.info.Size())
+		return nil
+	})
+	return preview, err
+}
+
+// writeArchive streams the selected files below root to w in the given
+// format. Nothing is buffered on disk; output is flushed after each file
+// so clients see progress on both HTTP/1.1 and HTTP/3.
+func writeArchive(ctx context.Context, w io.Writer, root, format, prefix string, filter ArchiveFilter) error {
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	switch format {
+	case ArchiveFormatZip:
+		zw := zip.NewWriter(w)
+		err := walkArchive(ctx, root, filter, func(f archiveFile) error {
+			header, err := zip.FileInfoHeader(f.info)
+			if err != nil {
+				return err
+			}
+			header.Name = path.Join(prefix, f.rel)
+			header.Method = zip.Deflate
+			if archiveStoredExtensions[strings.ToLower(path.Ext(f.rel))] {
+				header.Method = zip.Store
+			}
+			dst, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if err := copyArchiveFile(dst, f.path, f.info.Size()); err != nil {
+				return err
+			}
+			flush()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+
+	case ArchiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		err := walkArchive(ctx, root, filter, func(f archiveFile) error {
+			header, err := tar.FileInfoHeader(f.info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = path.Join(prefix, f.rel)
+			// Owner names mean nothing on the receiving machine
+			header.Uname, header.Gname = "", ""
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := copyArchiveFile(tw, f.path, f.info.Size()); err != nil {
+				return err
+			}
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+			flush()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+
+	default:
+		return fmt.Errorf("unsupported archive format: %q", format)
+	}
+}
+
+// copyArchiveFile copies a file into an archive entry. The file may have
+// changed size since it was listed, so exactly the listed size is written.
+func copyArchiveFile(dst io.Writer, src string, size int64) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.CopyN(dst, f, size)
+	if err == io.EOF {
+		// Shrunk while archiving; pad so the tar stream stays valid
+		_, err = io.CopyN(dst, zeroReader{}, size-n)
+	}
+	return err
+}
+
+// zeroReader yields an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditBodyLimit is the largest request body read to find the target of
+// an audited request; uploads and other large bodies are not inspected
+const auditBodyLimit = 64 << 10
+
+// auditTargetKeys are the request parameters that name what a request acts
+// on. Only these are recorded, so passwords and file contents never reach
+// the audit log.
+var auditTargetKeys = []string{"path", "paths", "id", "name", "username", "device", "snapshot", "dest", "version", "serial", "service", "job"}
+
+// AuditEntry records one state-changing request. Hash is an HMAC of the
+// entry and the hash of the entry before it, so editing or removing an
+// entry breaks the chain from that point on, and without the key the chain
+// cannot be rebuilt.
+type AuditEntry struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	AuthBy    string    `json:"auth_method"`
+	SourceIP  string    `json:"source_ip"`
+	Protocol  string    `json:"protocol"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+	RequestID string    `json:"request_id"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// auditHash computes the chain hash of e, which must not have Hash set
+func auditHash(key []byte, e AuditEntry) (string, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// loadAuditKey reads a hex-encoded 256-bit key, generating one if missing
+func loadAuditKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write audit key: %w", err)
+		}
+		storageLog.Info("Generated new audit key", "path", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit key: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("audit key must be 64 hex characters: %s", path)
+	}
+	return key, nil
+}
+
+// AuditLog is an append-only, hash-chained log of state-changing requests
+// kept in the state directory on the storage volume. The chain is keyed
+// with audit.key_file, which lives outside it.
+type AuditLog struct {
+	path string
+	key  []byte
+
+	mu      sync.Mutex
+	seq     uint64
+	last    string
+	lastErr error
+}
+
+// NewAuditLog opens the audit log and finds where the chain ends
+func NewAuditLog(cfg *Config) *AuditLog {
+	a := &AuditLog{path: filepath.Join(cfg.GetStateDir(), "audit.log")}
+	key, err := loadAuditKey(cfg.Audit.KeyFile)
+	if err != nil {
+		a.lastErr = err
+		storageLog.Error("Audit log disabled", "error", err)
+		return a
+	}
+	a.key = key
+	result, err := a.scan(nil)
+	if err != nil && !os.IsNotExist(err) {
+		a.lastErr = err
+		storageLog.Error("Failed to read audit log", "path", a.path, "error", err)
+	}
+	if result.Error != "" {
+		storageLog.Error("Audit log chain is broken", "path", a.path, "seq", result.BrokenAt, "error", result.Error)
+	}
+	a.seq, a.last = result.lastSeq, result.lastHash
+	// Entries cut off the end leave a valid chain; the heads logged here
+	// and for every new entry let that be checked against the journal
+	storageLog.Info("Audit log opened", "path", a.path, "entries", a.seq, "head", a.last)
+	return a
+}
+
+// Record appends e to the log, filling in the sequence number and hashes
+func (a *AuditLog) Record(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.key == nil {
+		return a.lastErr
+	}
+
+	e.Seq = a.seq + 1
+	e.Prev = a.last
+	e.Hash = ""
+	hash, err := auditHash(a.key, e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = a.append(append(line, '\n'))
+	a.lastErr = err
+	if err != nil {
+		return err
+	}
+	a.seq, a.last = e.Seq, e.Hash
+	storageLog.Info("Audit entry recorded", "seq", e.Seq, "action", e.Action, "head", e.Hash)
+	return nil
+}
+
+func (a *AuditLog) append(line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Alerts reports a failure to write the audit log
+func (a *AuditLog) Alerts() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastErr != nil {
+		return []string{"Audit log unavailable: " + a.lastErr.Error()}
+	}
+	return nil
+}
+
+// AuditFilter selects audit entries. Empty fields match everything; User,
+// SourceIP and Result must match exactly, Action and Target are substrings.
+type AuditFilter struct {
+	User     string
+	SourceIP string
+	Action   string
+	Target   string
+	Result   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.SourceIP == "" || e.SourceIP == f.SourceIP) &&
+		(f.Result == "" || e.Result == f.Result) &&
+		(f.Action == "" || strings.Contains(e.Action, f.Action)) &&
+		(f.Target == "" || strings.Contains(e.Target, f.Target)) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// AuditResult is the outcome of reading the audit log: the matching
+// entries, newest first, and whether the hash chain is intact. BrokenAt is
+// the sequence number of the first entry that does not verify.
+type AuditResult struct {
+	Entries  []AuditEntry `json:"entries"`
+	Total    int          `json:"total"`
+	Verified uint64       `json:"verified"`
+	ChainOK  bool         `json:"chain_ok"`
+	BrokenAt uint64       `json:"broken_at,omitempty"`
+	Error    string       `json:"error,omitempty"`
+
+	lastSeq  uint64
+	lastHash string
+}
+
+// Query returns entries matching f and verifies the whole chain
+func (a *AuditLog) Query(f AuditFilter) (AuditResult, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.key == nil {
+		return AuditResult{}, a.lastErr
+	}
+	result, err := a.scan(&f)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return result, err
+}
+
+// scan reads the log, checking every entry against the chain. Entries
+// matching f are returned if f is not nil.
+func (a *AuditLog) scan(f *AuditFilter) (AuditResult, error) {
+	result := AuditResult{Entries: []AuditEntry{}, ChainOK: true}
+	file, err := os.Open(a.path)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			result.fail(result.lastSeq+1, fmt.Errorf("unreadable entry: %w", err))
+			continue
+		}
+		if result.ChainOK {
+			hash := e.Hash
+			e.Hash = ""
+			want, err := auditHash(a.key, e)
+			e.Hash = hash
+			switch {
+			case err != nil:
+				result.fail(e.Seq, err)
+			case e.Seq != result.lastSeq+1:
+				result.fail(e.Seq, fmt.Errorf("expected entry %d", result.lastSeq+1))
+			case e.Prev != result.lastHash:
+				result.fail(e.Seq, fmt.Errorf("previous hash does not match"))
+			case hash != want:
+				result.fail(e.Seq, fmt.Errorf("entry hash does not match its contents"))
+			default:
+				result.Verified++
+			}
+		}
+		// Appends continue after the last entry even if the chain broke
+		// earlier, so the break stays visible rather than being hidden
+		result.lastSeq, result.lastHash = e.Seq, e.Hash
+
+		if f != nil && f.matches(e) {
+			result.Total++
+			result.Entries = append(result.Entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	// Newest first, limited
+	slices.Reverse(result.Entries)
+	if f != nil && f.Limit > 0 && len(result.Entries) > f.Limit {
+		result.Entries = result.Entries[:f.Limit]
+	}
+	return result, nil
+}
+
+func (r *AuditResult) fail(seq uint64, err error) {
+	if r.ChainOK {
+		r.ChainOK = false
+		r.BrokenAt = seq
+		r.Error = err.Error()
+	}
+}
+
+// auditRequest collects what the audit log needs to know about a request
+// while it is handled
+type auditRequest struct {
+	principal Principal
+}
+
+type auditKey struct{}
+
+// noteAuditPrincipal records who made an audited request, once
+// authentication has established it
+func noteAuditPrincipal(ctx context.Context, p Principal) {
+	if ar, ok := ctx.Value(auditKey{}).(*auditRequest); ok {
+		ar.principal = p
+	}
+}
+
+// isMutating reports whether a request method changes state
+func isMutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// audited records state-changing requests in the audit log, including
+// ones refused by access control before they reach a route
+func (s *APIServer) audited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := auditTarget(r)
+		ar := &auditRequest{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, ar)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		_, route := s.mux.Handler(r)
+		e := AuditEntry{
+			Time:      time.Now().UTC(),
+			User:      ar.principal.Username,
+			AuthBy:    ar.principal.Method,
+			Protocol:  requestProtocol(r),
+			Action:    r.Method + " " + route,
+			Target:    target,
+			Status:    rec.status,
+			Result:    auditResult(rec.status),
+			RequestID: requestIDFrom(r.Context()),
+		}
+		if ip, _ := s.access.Load().ClientIP(r); ip != nil {
+			e.SourceIP = ip.String()
+		}
+		if err := s.audit.Record(e); err != nil {
+			storageLog.ErrorContext(r.Context(), "Failed to write audit log", "action", e.Action, "error", err)
+		}
+	})
+}
+
+// auditResult classifies a response status
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= 400:
+		return "failed"
+	default:
+		return "ok"
+	}
+}
+
+// auditTarget describes what a request acts on from its query string and
+// small JSON or form bodies, which are put back for the handler
+func auditTarget(r *http.Request) string {
+	values := r.URL.Query()
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body != nil && r.ContentLength >= 0 && r.ContentLength <= auditBodyLimit &&
+		(ct == "application/json" || ct == "application/x-www-form-urlencoded") {
+		data, err := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit+1))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+		if err == nil && len(data) <= auditBodyLimit {
+			if ct == "application/json" {
+				var body map[string]any
+				if json.Unmarshal(data, &body) == nil {
+					for k, v := range body {
+						switch v := v.(type) {
+						case string:
+							values.Add(k, v)
+						case []any:
+							for _, item := range v {
+								if s, ok := item.(string); ok {
+									values.Add(k, s)
+								}
+							}
+						}
+					}
+				}
+			} else if form, err := url.ParseQuery(string(data)); err == nil {
+				for k, vs := range form {
+					values[k] = append(values[k], vs...)
+				}
+			}
+		}
+	}
+
+	var parts []string
+	for _, k := range auditTargetKeys {
+		for _, v := range values[k] {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
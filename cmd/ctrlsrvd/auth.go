@@ -0,0 +1,863 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is a permission level; each role includes the ones below it
+type Role string
+
+// Roles
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// sessionCookie is the name of the UI session cookie
+const sessionCookie = "ctrlsrv_session"
+
+// tokenPrefix marks ctrlsrv API tokens so they are easy to spot in scripts
+const tokenPrefix = "cts_"
+
+var (
+	errInvalidCredentials = errors.New("invalid username or password")
+	errUserNotFound       = errors.New("user not found")
+	errTokenNotFound      = errors.New("token not found")
+)
+
+// level orders roles; unknown roles have no permissions
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Allows reports whether r includes the permissions of required
+func (r Role) Allows(required Role) bool {
+	return r.level() > 0 && r.level() >= required.level()
+}
+
+// validRole reports whether r names a known role
+func validRole(r Role) bool {
+	return r.level() > 0
+}
+
+// validUsername reports whether name is a usable account name
+func validUsername(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Principal is the authenticated identity behind a request
+type Principal struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	Method   string `json:"method"`
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying p
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal of an authenticated request
+func principalFrom(r *http.Request) (Principal, bool) {
+	p, ok := r.Context().Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// User is a local account
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Role         Role      `json:"role"`
+	Created      time.Time `json:"created"`
+}
+
+// UserInfo is the public view of a user
+type UserInfo struct {
+	Username string    `json:"username"`
+	Role     Role      `json:"role"`
+	Created  time.Time `json:"created"`
+}
+
+// Session is a logged-in UI session. Only a hash of the cookie is stored.
+type Session struct {
+	Hash     string    `json:"hash"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// APIToken is a bearer token for scripts. Only a hash of the secret is
+// stored; the token itself is shown once when created.
+type APIToken struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Username string    `json:"username"`
+	Role     Role      `json:"role"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// TokenInfo is the public view of an API token
+type TokenInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Username string    `json:"username"`
+	Role     Role      `json:"role"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// authDB is the on-disk form of the auth database
+type authDB struct {
+	Users    []*User     `json:"users"`
+	Sessions []*Session  `json:"sessions"`
+	Tokens   []*APIToken `json:"tokens"`
+}
+
+// AuthManager manages local users, UI sessions and API tokens. Everything
+// is kept in auth.db_file, readable only by ctrlsrv.
+type AuthManager struct {
+	config atomic.Pointer[Config]
+
+	mu       sync.Mutex
+	users    map[string]*User
+	sessions map[string]*Session
+	tokens   map[string]*APIToken
+	loaded   bool
+}
+
+// NewAuthManager creates a new auth manager
+func NewAuthManager(cfg *Config) *AuthManager {
+	a := &AuthManager{
+		users:    make(map[string]*User),
+		sessions: make(map[string]*Session),
+		tokens:   make(map[string]*APIToken),
+	}
+	a.config.Store(cfg)
+	return a
+}
+
+// SetConfig applies a reloaded configuration to new sessions
+func (a *AuthManager) SetConfig(cfg *Config) {
+	a.config.Store(cfg)
+}
+
+func (a *AuthManager) dbPath() string {
+	return a.config.Load().Auth.DBFile
+}
+
+// initialPasswordPath is where Bootstrap leaves the admin password, next
+// to the database. It is removed once the password is changed.
+func (a *AuthManager) initialPasswordPath() string {
+	return filepath.Join(filepath.Dir(a.dbPath()), "initial-admin-password")
+}
+
+// load reads the database on first use. Caller holds a.mu.
+func (a *AuthManager) load() error {
+	if a.loaded {
+		return nil
+	}
+	cfg := a.config.Load()
+	if err := moveFromStateDir(cfg, "auth.json", a.dbPath()); err != nil {
+		return err
+	}
+	if err := moveFromStateDir(cfg, "initial-admin-password", a.initialPasswordPath()); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.dbPath())
+	if err == nil {
+		var db authDB
+		if err := json.Unmarshal(data, &db); err != nil {
+			return fmt.Errorf("failed to parse auth database: %w", err)
+		}
+		for _, u := range db.Users {
+			a.users[u.Username] = u
+		}
+		for _, s := range db.Sessions {
+			a.sessions[s.Hash] = s
+		}
+		for _, t := range db.Tokens {
+			a.tokens[t.ID] = t
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read auth database: %w", err)
+	}
+	a.loaded = true
+	return nil
+}
+
+// save persists the database, dropping expired sessions. Caller holds a.mu.
+func (a *AuthManager) save() error {
+	db := authDB{Users: []*User{}, Sessions: []*Session{}, Tokens: []*APIToken{}}
+	for _, u := range a.users {
+		db.Users = append(db.Users, u)
+	}
+	now := time.Now()
+	for hash, s := range a.sessions {
+		if now.After(s.Expires) {
+			delete(a.sessions, hash)
+			continue
+		}
+		db.Sessions = append(db.Sessions, s)
+	}
+	for _, t := range a.tokens {
+		db.Tokens = append(db.Tokens, t)
+	}
+	sort.Slice(db.Users, func(i, j int) bool { return db.Users[i].Username < db.Users[j].Username })
+	sort.Slice(db.Sessions, func(i, j int) bool { return db.Sessions[i].Created.Before(db.Sessions[j].Created) })
+	sort.Slice(db.Tokens, func(i, j int) bool { return db.Tokens[i].Created.Before(db.Tokens[j].Created) })
+
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.dbPath()), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(a.dbPath(), data, 0600)
+}
+
+// randomToken returns n random bytes encoded for use in cookies and tokens
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the stored form of a session or token secret
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// Bootstrap creates an admin account with a random password if no users
+// exist yet. The password is written to a file next to the database
+// rather than logged, since logs are kept and shown on the Logs page.
+func (a *AuthManager) Bootstrap() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	if len(a.users) > 0 {
+		return nil
+	}
+
+	password, err := randomToken(12)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.users["admin"] = &User{Username: "admin", PasswordHash: string(hash), Role: RoleAdmin, Created: time.Now()}
+	if err := a.save(); err != nil {
+		delete(a.users, "admin")
+		return err
+	}
+	if err := writeFileAtomic(a.initialPasswordPath(), []byte(password+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write initial password: %w", err)
+	}
+
+	authLog.Warn("Created initial user \"admin\"; its password is in the file, change it from the Account page", "file", a.initialPasswordPath())
+	return nil
+}
+
+// Password guessing is slowed per client address: after loginFreeAttempts
+// failures each further one doubles the wait, up to loginMaxDelay.
+// Failures are forgotten loginFailureTTL after the last one.
+const (
+	loginFreeAttempts = 5
+	loginMaxDelay     = 5 * time.Minute
+	loginFailureTTL   = 30 * time.Minute
+)
+
+// loginThrottle tracks failed password checks for UI logins and share
+// links, keyed by client address
+type loginThrottle struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: make(map[string]*loginFailures)}
+}
+
+// Wait returns how long key must wait before its next password is checked
+func (t *loginThrottle) Wait(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	return max(time.Until(f.until), 0)
+}
+
+// Fail records a wrong password from key
+func (t *loginThrottle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, f := range t.failures {
+		if now.Sub(f.last) > loginFailureTTL {
+			delete(t.failures, k)
+		}
+	}
+	f, ok := t.failures[key]
+	if !ok {
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count > loginFreeAttempts {
+		delay := loginMaxDelay
+		if n := f.count - loginFreeAttempts - 1; n < 20 {
+			delay = min(time.Second<<n, loginMaxDelay)
+		}
+		f.until = now.Add(delay)
+	}
+}
+
+// Succeed clears the failures of key
+func (t *loginThrottle) Succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// throttleKey identifies the client of r for loginThrottle
+func throttleKey(r *http.Request) string {
+	if ip, _ := clientIPFrom(r); ip != nil {
+		return ip.String()
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return host
+}
+
+// dummyHash is compared against when a username does not exist, so login
+// takes as long as for a real account and usernames cannot be probed
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("ctrlsrv"), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkPassword returns the user if password is correct
+func (a *AuthManager) checkPassword(username, password string) (User, error) {
+	a.mu.Lock()
+	if err := a.load(); err != nil {
+		a.mu.Unlock()
+		return User{}, err
+	}
+	u, ok := a.users[username]
+	var user User
+	if ok {
+		user = *u
+	}
+	a.mu.Unlock()
+
+	// bcrypt is slow on purpose; don't hold the lock for it
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return User{}, errInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return User{}, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// Login checks a username and password and starts a session, returning
+// the cookie value
+func (a *AuthManager) Login(username, password string) (string, time.Time, error) {
+	u, err := a.checkPassword(username, password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	s := &Session{
+		Hash:     hashSecret(secret),
+		Username: u.Username,
+		Created:  time.Now(),
+		Expires:  time.Now().Add(a.config.Load().Auth.SessionTTL),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sessions[s.Hash] = s
+	if err := a.save(); err != nil {
+		delete(a.sessions, s.Hash)
+		return "", time.Time{}, err
+	}
+
+	authLog.Info("User logged in", "user", u.Username)
+	return secret, s.Expires, nil
+}
+
+// Logout ends the session identified by a cookie value
+func (a *AuthManager) Logout(secret string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	hash := hashSecret(secret)
+	if _, ok := a.sessions[hash]; !ok {
+		return nil
+	}
+	delete(a.sessions, hash)
+	return a.save()
+}
+
+// Session returns the principal for a session cookie value
+func (a *AuthManager) Session(secret string) (Principal, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.load() != nil {
+		return Principal{}, false
+	}
+	s, ok := a.sessions[hashSecret(secret)]
+	if !ok || time.Now().After(s.Expires) {
+		return Principal{}, false
+	}
+	u, ok := a.users[s.Username]
+	if !ok {
+		return Principal{}, false
+	}
+	return Principal{Username: u.Username, Role: u.Role, Method: "session"}, true
+}
+
+// Token returns the principal for a bearer token
+func (a *AuthManager) Token(token string) (Principal, bool) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), "_")
+	if !ok {
+		return Principal{}, false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.load() != nil {
+		return Principal{}, false
+	}
+	t, ok := a.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashSecret(secret))) != 1 {
+		return Principal{}, false
+	}
+	if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		return Principal{}, false
+	}
+	u, ok := a.users[t.Username]
+	if !ok {
+		return Principal{}, false
+	}
+
+	// A token never grants more than its owner currently has
+	role := t.Role
+	if !u.Role.Allows(role) {
+		role = u.Role
+	}
+	// Persisted with the next change; not worth a write per request
+	t.LastUsed = time.Now()
+	return Principal{Username: u.Username, Role: role, Method: "token"}, true
+}
+
+// Users lists all accounts
+func (a *AuthManager) Users() ([]UserInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	list := make([]UserInfo, 0, len(a.users))
+	for _, u := range a.users {
+		list = append(list, UserInfo{Username: u.Username, Role: u.Role, Created: u.Created})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+// SetUser creates a user or updates its role and, if given, password
+func (a *AuthManager) SetUser(username, password string, role Role) error {
+	if !validUsername(username) {
+		return fmt.Errorf("invalid username: use letters, digits, '.', '-' and '_'")
+	}
+	if !validRole(role) {
+		return fmt.Errorf("invalid role: %q", role)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	u, exists := a.users[username]
+	if !exists {
+		if password == "" {
+			return fmt.Errorf("password is required for new users")
+		}
+		u = &User{Username: username, Created: time.Now()}
+	}
+	if exists && u.Role == RoleAdmin && role != RoleAdmin && a.countAdmins() == 1 {
+		return fmt.Errorf("cannot demote the last admin")
+	}
+
+	updated := *u
+	updated.Role = role
+	if password != "" {
+		if len(password) < 8 {
+			return fmt.Errorf("password must be at least 8 characters")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		updated.PasswordHash = string(hash)
+	}
+	a.users[username] = &updated
+	if err := a.save(); err != nil {
+		if exists {
+			a.users[username] = u
+		} else {
+			delete(a.users, username)
+		}
+		return err
+	}
+
+	if password != "" && exists {
+		a.dropSessions(username)
+		if username == "admin" {
+			os.Remove(a.initialPasswordPath())
+		}
+	}
+	authLog.Info("Saved user", "user", username, "role", role)
+	return nil
+}
+
+// ChangePassword sets a new password after checking the current one
+func (a *AuthManager) ChangePassword(username, current, password string) error {
+	if password == "" {
+		return fmt.Errorf("new password is required")
+	}
+	u, err := a.checkPassword(username, current)
+	if err != nil {
+		return err
+	}
+	return a.SetUser(username, password, u.Role)
+}
+
+// DeleteUser removes a user with its sessions and tokens
+func (a *AuthManager) DeleteUser(username string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	u, ok := a.users[username]
+	if !ok {
+		return errUserNotFound
+	}
+	if u.Role == RoleAdmin && a.countAdmins() == 1 {
+		return fmt.Errorf("cannot delete the last admin")
+	}
+
+	delete(a.users, username)
+	a.dropSessions(username)
+	for id, t := range a.tokens {
+		if t.Username == username {
+			delete(a.tokens, id)
+		}
+	}
+	authLog.Info("Deleted user", "user", username)
+	return a.save()
+}
+
+// countAdmins returns the number of admin accounts. Caller holds a.mu.
+func (a *AuthManager) countAdmins() int {
+	n := 0
+	for _, u := range a.users {
+		if u.Role == RoleAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// dropSessions ends every session of a user. Caller holds a.mu and saves.
+func (a *AuthManager) dropSessions(username string) {
+	for hash, s := range a.sessions {
+		if s.Username == username {
+			delete(a.sessions, hash)
+		}
+	}
+}
+
+// Tokens lists API tokens; an empty username lists everyone's
+func (a *AuthManager) Tokens(username string) ([]TokenInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	list := []TokenInfo{}
+	for _, t := range a.tokens {
+		if username != "" && t.Username != username {
+			continue
+		}
+		list = append(list, TokenInfo{
+			ID:       t.ID,
+			Name:     t.Name,
+			Username: t.Username,
+			Role:     t.Role,
+			Created:  t.Created,
+			Expires:  t.Expires,
+			LastUsed: t.LastUsed,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, nil
+}
+
+// CreateToken issues a token for p limited to role. The returned token is
+// not stored and cannot be shown again.
+func (a *AuthManager) CreateToken(p Principal, name string, role Role, ttl time.Duration) (string, TokenInfo, error) {
+	if !validRole(role) {
+		return "", TokenInfo{}, fmt.Errorf("invalid role: %q", role)
+	}
+	if !p.Role.Allows(role) {
+		return "", TokenInfo{}, fmt.Errorf("cannot create a token with more permissions than your own")
+	}
+
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", TokenInfo{}, err
+	}
+	secret, err := randomToken(24)
+	if err != nil {
+		return "", TokenInfo{}, err
+	}
+	// The secret is base64url and may contain '_', so the ID must not
+	id := hex.EncodeToString(idBytes)
+	t := &APIToken{
+		ID:       id,
+		Name:     name,
+		Username: p.Username,
+		Role:     role,
+		Hash:     hashSecret(secret),
+		Created:  time.Now(),
+	}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return "", TokenInfo{}, err
+	}
+	a.tokens[id] = t
+	if err := a.save(); err != nil {
+		delete(a.tokens, id)
+		return "", TokenInfo{}, err
+	}
+
+	authLog.Info("Created API token", "user", p.Username, "token", id, "name", name, "role", role)
+	info := TokenInfo{ID: id, Name: name, Username: p.Username, Role: role, Created: t.Created, Expires: t.Expires}
+	return tokenPrefix + id + "_" + secret, info, nil
+}
+
+// RevokeToken deletes a token. Non-admins may only revoke their own.
+func (a *AuthManager) RevokeToken(p Principal, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.load(); err != nil {
+		return err
+	}
+	t, ok := a.tokens[id]
+	if !ok || (t.Username != p.Username && !p.Role.Allows(RoleAdmin)) {
+		return errTokenNotFound
+	}
+	delete(a.tokens, id)
+	authLog.Info("Revoked API token", "user", p.Username, "token", id, "name", t.Name)
+	return a.save()
+}
+
+// routePolicy gives the minimum role needed to read a route (GET, HEAD)
+// and to change anything through it (all other methods). An empty role
+// means no authentication is needed.
+type routePolicy struct {
+	read  Role
+	write Role
+}
+
+var (
+	policyPublic   = routePolicy{}
+	policyViewer   = routePolicy{read: RoleViewer, write: RoleOperator}
+	policyOperator = routePolicy{read: RoleOperator, write: RoleOperator}
+	policyAdmin    = routePolicy{read: RoleAdmin, write: RoleAdmin}
+	policySelf     = routePolicy{read: RoleViewer, write: RoleViewer}
+)
+
+// authenticate identifies the caller of r, if any
+func (s *APIServer) authenticate(r *http.Request) (Principal, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return s.auth.Token(strings.TrimSpace(token))
+		}
+		return Principal{}, false
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if p, ok := s.auth.Session(c.Value); ok {
+			return p, true
+		}
+	}
+	if p, ok := s.certificatePrincipal(r); ok {
+		return p, true
+	}
+	if role := Role(s.config.Load().Auth.LocalRole); role != "" && isLoopbackRequest(r) {
+		return Principal{Username: "local", Role: role, Method: "local"}, true
+	}
+	return Principal{}, false
+}
+
+// isLoopbackRequest reports whether r comes from this machine, such as
+// the kiosk browser. Requests relayed by a proxy on this machine carry the
+// original client address and do not count.
+func isLoopbackRequest(r *http.Request) bool {
+	ip, forwarded := clientIPFrom(r)
+	if forwarded || viaTunnel(r) || hasProxyHeaders(r) {
+		return false
+	}
+	if ip == nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	return ip != nil && ip.IsLoopback()
+}
+
+// isAPIRequest reports whether r should get JSON errors rather than a
+// redirect to the login page
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || r.Header.Get("Authorization") != ""
+}
+
+// sameOrigin reports whether a request comes from a page served by this
+// host, going by Origin or else Referer. Clients that send neither, such
+// as scripts, pass.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// requireRole wraps h so only principals allowed by policy reach it
+func (s *APIServer) requireRole(policy routePolicy, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Browsers send cookies and client certificates with cross-site
+		// posts, and the kiosk's are local, so changes from pages on other
+		// sites are refused. Bearer tokens are never sent implicitly.
+		if isMutating(r.Method) && r.Header.Get("Authorization") == "" && !sameOrigin(r) {
+			authLog.WarnContext(r.Context(), "Cross-site request refused", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"), "referer", r.Header.Get("Referer"))
+			jsonError(w, http.StatusForbidden, "cross-site request refused")
+			return
+		}
+
+		required := policy.write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = policy.read
+		}
+		if !s.config.Load().Auth.Enabled || required == "" {
+			h(w, r)
+			return
+		}
+
+		p, ok := s.authenticate(r)
+		if !ok {
+			if isAPIRequest(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="ctrlsrv"`)
+				jsonError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		noteAuditPrincipal(r.Context(), p)
+		if !p.Role.Allows(required) {
+			authLog.WarnContext(r.Context(), "Permission denied", "method", r.Method, "path", r.URL.Path, "user", p.Username, "role", p.Role, "required", required)
+			jsonError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		h(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+// handle registers a route guarded by policy, with request metrics
+// recorded under pattern
+func (s *APIServer) handle(pattern string, policy routePolicy, h http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.metrics.instrument(pattern, s.requireRole(policy, h)))
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupChunkSize is the fixed size files are split into for deduplication
+const backupChunkSize = 4 << 20
+
+// snapshotIDLayout is the time layout snapshot IDs are named with
+const snapshotIDLayout = "20060102T150405Z"
+
+// errBackupBusy is returned when another backup operation is in progress
+var errBackupBusy = errors.New("another backup operation is in progress")
+
+// errNoRetention is returned by Prune when no retention is configured,
+// which would otherwise remove every snapshot
+var errNoRetention = errors.New("no retention configured: set backup.keep_last or backup.keep_daily")
+
+// BackupManager runs scheduled, incremental, deduplicated and encrypted
+// backups of storage paths into a repository on a second disk.
+//
+// Repository layout:
+//
+//	<target>/keycheck           encrypted marker used to detect a wrong key
+//	<target>/chunks/ab/abcd...  encrypted file chunks, named by keyed hash
+//	<target>/snapshots/<id>     encrypted JSON snapshot manifests
+type BackupManager struct {
+	config *Config
+
+	mu     sync.Mutex
+	status BackupStatus
+}
+
+// BackupStatus is the current state of the backup subsystem
+type BackupStatus struct {
+	Enabled      bool      `json:"enabled"`
+	Target       string    `json:"target"`
+	Operation    string    `json:"operation,omitempty"`
+	LastRun      time.Time `json:"last_run,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastSnapshot string    `json:"last_snapshot,omitempty"`
+	NextRun      time.Time `json:"next_run,omitempty"`
+	Snapshots    int       `json:"snapshots"`
+	RepoSize     uint64    `json:"repo_size_bytes"`
+}
+
+// BackupSnapshot describes one point-in-time backup
+type BackupSnapshot struct {
+	ID    string       `json:"id"`
+	Time  time.Time    `json:"time"`
+	Paths []string     `json:"paths"`
+	Size  uint64       `json:"size_bytes"`
+	Files []BackupFile `json:"files,omitempty"`
+}
+
+// BackupFile is a single file entry inside a snapshot
+type BackupFile struct {
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Chunks  []string    `json:"chunks"`
+}
+
+// BackupVerifyResult reports the outcome of a repository verification
+type BackupVerifyResult struct {
+	Snapshots int      `json:"snapshots"`
+	Chunks    int      `json:"chunks"`
+	Errors    []string `json:"errors"`
+}
+
+// BackupPruneResult reports what a prune removed
+type BackupPruneResult struct {
+	SnapshotsRemoved int `json:"snapshots_removed"`
+	ChunksRemoved    int `json:"chunks_removed"`
+}
+
+// NewBackupManager creates a new backup manager
+func NewBackupManager(cfg *Config) *BackupManager {
+	return &BackupManager{
+		config: cfg,
+		status: BackupStatus{
+			Enabled: cfg.Backup.Enabled,
+			Target:  cfg.Backup.Target,
+		},
+	}
+}
+
+// Status returns a copy of the current backup status
+func (b *BackupManager) Status() BackupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// Run schedules backups until ctx is cancelled
+func (b *BackupManager) Run(ctx context.Context) {
+	if !b.config.Backup.Enabled {
+		return
+	}
+
+	// Pick up where the previous process left off
+	if snaps, err := b.Snapshots(); err == nil && len(snaps) > 0 {
+		last := snaps[len(snaps)-1]
+		b.mu.Lock()
+		b.status.LastSuccess = last.Time
+		b.status.LastSnapshot = last.ID
+		b.status.Snapshots = len(snaps)
+		b.mu.Unlock()
+	}
+	b.updateRepoSize()
+
+	for {
+		next := b.Status().LastSuccess.Add(b.config.Backup.Interval)
+		if minNext := time.Now().Add(time.Minute); next.Before(minNext) {
+			next = minNext
+		}
+		b.mu.Lock()
+		b.status.NextRun = next
+		b.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// Failures are logged and recorded in the status by Backup
+		if _, err := b.Backup(ctx); err != nil {
+			continue
+		}
+		if b.config.Backup.KeepLast > 0 || b.config.Backup.KeepDaily > 0 {
+			if _, err := b.Prune(ctx); err != nil {
+				backupLog.Error("Backup prune failed", "error", err)
+			}
+		}
+	}
+}
+
+// begin marks an operation as running, failing if one already is
+func (b *BackupManager) begin(op string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.status.Operation != "" {
+		return errBackupBusy
+	}
+	b.status.Operation = op
+	return nil
+}
+
+// end clears the running operation
+func (b *BackupManager) end() {
+	b.mu.Lock()
+	b.status.Operation = ""
+	b.mu.Unlock()
+	b.updateRepoSize()
+}
+
+// Backup creates a new snapshot of the configured paths
+func (b *BackupManager) Backup(ctx context.Context) (*BackupSnapshot, error) {
+	if err := b.begin("backup"); err != nil {
+		return nil, err
+	}
+	defer b.end()
+
+	start := time.Now()
+	snap, err := b.backup(ctx)
+
+	b.mu.Lock()
+	b.status.LastRun = start
+	if err != nil {
+		b.status.LastError = err.Error()
+	} else {
+		b.status.LastError = ""
+		b.status.LastSuccess = snap.Time
+		b.status.LastSnapshot = snap.ID
+		b.status.Snapshots++
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		backupLog.Error("Backup failed", "target", b.config.Backup.Target, "error", err)
+		return nil, err
+	}
+	backupLog.Info("Backup snapshot complete", "snapshot", snap.ID, "files", len(snap.Files),
+		"size", formatBytes(snap.Size), "duration", time.Since(start).Round(time.Second))
+	return snap, nil
+}
+
+func (b *BackupManager) backup(ctx context.Context) (*BackupSnapshot, error) {
+	repo, err := b.openRepo()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStorage(b.config.Storage.Path); err != nil {
+		return nil, err
+	}
+
+	// Index the previous snapshot so unchanged files are not re-read
+	previous := make(map[string]BackupFile)
+	if snaps, err := b.Snapshots(); err == nil && len(snaps) > 0 {
+		if last, err := repo.loadSnapshot(snaps[len(snaps)-1].ID); err == nil {
+			for _, f := range last.Files {
+				previous[f.Path] = f
+			}
+		}
+	}
+
+	// IDs have one-second resolution; wait rather than overwrite a
+	// snapshot taken earlier in the same second
+	now := time.Now().UTC()
+	for {
+		if _, err := os.Stat(repo.snapshotPath(now.Format(snapshotIDLayout))); os.IsNotExist(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(now.Truncate(time.Second).Add(time.Second).Sub(now)):
+		}
+		now = time.Now().UTC()
+	}
+	snap := &BackupSnapshot{
+		ID:    now.Format(snapshotIDLayout),
+		Time:  now,
+		Paths: b.config.Backup.Paths,
+	}
+
+	for _, rel := range b.config.Backup.Paths {
+		root, err := resolveStoragePath(b.config.Storage.Path, rel)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() {
+				if d.Name() != "." && strings.HasPrefix(d.Name(), ".ctrlsrv") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(b.config.Storage.Path, path)
+			if err != nil {
+				return err
+			}
+
+			entry := BackupFile{
+				Path:    filepath.ToSlash(relPath),
+				Mode:    info.Mode().Perm(),
+				ModTime: info.ModTime().UTC(),
+				Size:    info.Size(),
+			}
+			if prev, ok := previous[entry.Path]; ok && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime) {
+				entry.Chunks = prev.Chunks
+			} else if entry.Chunks, err = repo.storeFile(path); err != nil {
+				return fmt.Errorf("failed to back up %s: %w", entry.Path, err)
+			}
+
+			snap.Files = append(snap.Files, entry)
+			snap.Size += uint64(entry.Size)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := repo.saveSnapshot(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Snapshots lists snapshots in the repository, oldest first, without file lists
+func (b *BackupManager) Snapshots() ([]BackupSnapshot, error) {
+	repo, err := b.openRepo()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	snaps := make([]BackupSnapshot, 0, len(ids))
+	for _, id := range ids {
+		snap, err := repo.loadSnapshot(id)
+		if err != nil {
+			backupLog.Warn("Skipping unreadable snapshot", "snapshot", id, "error", err)
+			continue
+		}
+		snap.Files = nil
+		snaps = append(snaps, *snap)
+	}
+	return snaps, nil
+}
+
+// Verify reads back every chunk referenced by any snapshot and checks it
+func (b *BackupManager) Verify(ctx context.Context) (*BackupVerifyResult, error) {
+	if err := b.begin("verify"); err != nil {
+		return nil, err
+	}
+	defer b.end()
+
+	repo, err := b.openRepo()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BackupVerifyResult{Errors: []string{}}
+	checked := make(map[string]bool)
+	for _, id := range ids {
+		snap, err := repo.loadSnapshot(id)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("snapshot %s: %v", id, err))
+			continue
+		}
+		result.Snapshots++
+		for _, f := range snap.Files {
+			for _, chunk := range f.Chunks {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if checked[chunk] {
+					continue
+				}
+				checked[chunk] = true
+				result.Chunks++
+				if _, err := repo.loadChunk(chunk); err != nil {
+					result.Errors = append(result.Errors, fmt.Sprintf("chunk %s (%s): %v", chunk, f.Path, err))
+				}
+			}
+		}
+	}
+
+	if len(result.Errors) > 0 {
+		backupLog.Error("Backup verification found errors", "errors", len(result.Errors))
+		b.mu.Lock()
+		b.status.LastError = fmt.Sprintf("verify: %d errors", len(result.Errors))
+		b.mu.Unlock()
+	}
+	return result, nil
+}
+
+// Prune removes snapshots outside the retention policy and unreferenced
+// chunks. The newest snapshot is always kept.
+func (b *BackupManager) Prune(ctx context.Context) (*BackupPruneResult, error) {
+	if b.config.Backup.KeepLast <= 0 && b.config.Backup.KeepDaily <= 0 {
+		return nil, errNoRetention
+	}
+	if err := b.begin("prune"); err != nil {
+		return nil, err
+	}
+	defer b.end()
+
+	repo, err := b.openRepo()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Decide which snapshots to keep, newest first
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	if len(ids) > 0 {
+		keep[ids[len(ids)-1]] = true
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		if len(ids)-1-i < b.config.Backup.KeepLast {
+			keep[id] = true
+		}
+		day := id[:8]
+		if !days[day] && len(days) < b.config.Backup.KeepDaily {
+			days[day] = true
+			keep[id] = true
+		}
+	}
+
+	result := &BackupPruneResult{}
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		if !keep[id] {
+			if err := os.Remove(repo.snapshotPath(id)); err != nil {
+				return nil, err
+			}
+			result.SnapshotsRemoved++
+			continue
+		}
+		snap, err := repo.loadSnapshot(id)
+		if err != nil {
+			// Never garbage collect while a kept snapshot is unreadable
+			return nil, fmt.Errorf("snapshot %s unreadable, refusing to prune chunks: %w", id, err)
+		}
+		for _, f := range snap.Files {
+			for _, chunk := range f.Chunks {
+				referenced[chunk] = true
+			}
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(repo.root, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		result.ChunksRemoved++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.status.Snapshots = len(ids) - result.SnapshotsRemoved
+	b.mu.Unlock()
+
+	backupLog.Info("Backup prune complete", "snapshots_removed", result.SnapshotsRemoved, "chunks_removed", result.ChunksRemoved)
+	return result, nil
+}
+
+// Restore writes files from a snapshot below dest (relative to storage path).
+// If prefix is non-empty only files under that path are restored.
+func (b *BackupManager) Restore(ctx context.Context, id, prefix, dest string) (int, error) {
+	if err := b.begin("restore"); err != nil {
+		return 0, err
+	}
+	defer b.end()
+
+	repo, err := b.openRepo()
+	if err != nil {
+		return 0, err
+	}
+	snap, err := repo.loadSnapshot(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if dest == "" {
+		dest = filepath.Join("restore", snap.ID)
+	}
+	destRoot, err := resolveUserPath(b.config, dest)
+	if err != nil {
+		return 0, err
+	}
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+
+	restored := 0
+	for _, f := range snap.Files {
+		if ctx.Err() != nil {
+			return restored, ctx.Err()
+		}
+		if prefix != "" && f.Path != prefix && !strings.HasPrefix(f.Path, prefix+"/") {
+			continue
+		}
+		target, err := resolveStoragePath(destRoot, f.Path)
+		if err != nil {
+			return restored, err
+		}
+		if err := repo.restoreFile(f, target); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+		restored++
+	}
+
+	backupLog.Info("Restore complete", "files", restored, "snapshot", snap.ID, "dest", destRoot)
+	return restored, nil
+}
+
+// updateRepoSize recomputes the on-disk size of the repository
+func (b *BackupManager) updateRepoSize() {
+	if b.config.Backup.Target == "" {
+		return
+	}
+	var size uint64
+	filepath.WalkDir(b.config.Backup.Target, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	b.mu.Lock()
+	b.status.RepoSize = size
+	b.mu.Unlock()
+}
+
+// backupRepo is an opened, unlocked backup repository
+type backupRepo struct {
+	root string
+	key  []byte
+	aead cipher.AEAD
+}
+
+// openRepo opens (initialising if needed) the configured repository
+func (b *BackupManager) openRepo() (*backupRepo, error) {
+	cfg := b.config.Backup
+	if cfg.Target == "" {
+		return nil, fmt.Errorf("backup target not configured")
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Target, "snapshots"), 0700); err != nil {
+		return nil, fmt.Errorf("backup target not writable: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Target, "chunks"), 0700); err != nil {
+		return nil, fmt.Errorf("backup target not writable: %w", err)
+	}
+
+	key, err := loadBackupKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	repo := &backupRepo{root: cfg.Target, key: key, aead: aead}
+
+	// Refuse to mix keys within one repository
+	checkPath := filepath.Join(cfg.Target, "keycheck")
+	if data, err := os.ReadFile(checkPath); err == nil {
+		if _, err := repo.open("keycheck", data); err != nil {
+			return nil, fmt.Errorf("backup key does not match repository at %s", cfg.Target)
+		}
+	} else if os.IsNotExist(err) {
+		if err := writeFileAtomic(checkPath, repo.seal("keycheck", []byte(appName)), 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// loadBackupKey reads a hex-encoded 256-bit key, generating one if missing
+func loadBackupKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("backup key_file not configured")
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write backup key: %w", err)
+		}
+		backupLog.Warn("Generated new backup key; keep a copy somewhere safe, backups cannot be restored without it", "path", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup key: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("backup key must be 64 hex characters: %s", path)
+	}
+	return key, nil
+}
+
+// seal encrypts data, binding it to name so blobs cannot be swapped
+func (r *backupRepo) seal(name string, data []byte) []byte {
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return r.aead.Seal(nonce, nonce, data, []byte(name))
+}
+
+// open decrypts a blob written by seal
+func (r *backupRepo) open(name string, data []byte) ([]byte, error) {
+	n := r.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("blob too short")
+	}
+	return r.aead.Open(nil, data[:n], data[n:], []byte(name))
+}
+
+// chunkID derives a chunk name from its plaintext without revealing its hash
+func (r *backupRepo) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (r *backupRepo) chunkPath(id string) string {
+	return filepath.Join(r.root, "chunks", id[:2], id)
+}
+
+func (r *backupRepo) snapshotPath(id string) string {
+	return filepath.Join(r.root, "snapshots", id)
+}
+
+// storeFile splits a file into chunks and stores any the repository lacks
+func (r *backupRepo) storeFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunks := []string{}
+	buf := make([]byte, backupChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			data := buf[:n]
+			id := r.chunkID(data)
+			dst := r.chunkPath(id)
+			if _, statErr := os.Stat(dst); os.IsNotExist(statErr) {
+				if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+					return nil, err
+				}
+				if err := writeFileAtomic(dst, r.seal(id, data), 0600); err != nil {
+					return nil, err
+				}
+			}
+			chunks = append(chunks, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// loadChunk reads, decrypts and authenticates a chunk
+func (r *backupRepo) loadChunk(id string) ([]byte, error) {
+	if len(id) != 64 {
+		return nil, fmt.Errorf("invalid chunk id")
+	}
+	data, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := r.open(id, data)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	if !hmac.Equal([]byte(r.chunkID(plain)), []byte(id)) {
+		return nil, fmt.Errorf("content hash mismatch")
+	}
+	return plain, nil
+}
+
+// restoreFile reassembles a file from its chunks at target
+func (r *backupRepo) restoreFile(f BackupFile, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp := target + ".ctrlsrv-restore"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode|0200)
+	if err != nil {
+		return err
+	}
+	for _, id := range f.Chunks {
+		data, err := r.loadChunk(id)
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	os.Chmod(target, f.Mode)
+	return os.Chtimes(target, f.ModTime, f.ModTime)
+}
+
+// snapshotIDs lists snapshot IDs in chronological order. Files that are
+// not named like a snapshot are ignored.
+func (r *backupRepo) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.root, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && validSnapshotID(e.Name()) {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// validSnapshotID reports whether id is a snapshot name
+func validSnapshotID(id string) bool {
+	_, err := time.Parse(snapshotIDLayout, id)
+	return err == nil
+}
+
+func (r *backupRepo) loadSnapshot(id string) (*BackupSnapshot, error) {
+	if !validSnapshotID(id) {
+		return nil, fmt.Errorf("invalid snapshot id: %q", id)
+	}
+	data, err := os.ReadFile(r.snapshotPath(id))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := r.open("snapshot:"+id, data)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	var snap BackupSnapshot
+	if err := json.Unmarshal(plain, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (r *backupRepo) saveSnapshot(snap *BackupSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.snapshotPath(snap.ID), r.seal("snapshot:"+snap.ID, data), 0600)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// caRootValidity is the lifetime of the generated root certificate
+const caRootValidity = 10 * 365 * 24 * time.Hour
+
+// crlValidity is how long a published CRL stays valid. It is re-signed
+// daily so relying parties never see a stale one.
+const (
+	crlValidity = 7 * 24 * time.Hour
+	crlRefresh  = 24 * time.Hour
+)
+
+var errCertNotFound = errors.New("certificate not found")
+
+// IssuedCert records a client certificate issued by the internal CA. The
+// private key is handed out once and never stored.
+type IssuedCert struct {
+	Serial      string    `json:"serial"`
+	Name        string    `json:"name"`
+	Role        Role      `json:"role,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Issued      time.Time `json:"issued"`
+	Expires     time.Time `json:"expires"`
+	Revoked     time.Time `json:"revoked,omitempty"`
+}
+
+// IssuedBundle is a freshly issued certificate with its key. P12 is set
+// when a password was given for the PKCS#12 export.
+type IssuedBundle struct {
+	Certificate IssuedCert `json:"certificate"`
+	CertPEM     string     `json:"cert_pem"`
+	KeyPEM      string     `json:"key_pem"`
+	P12         []byte     `json:"p12,omitempty"`
+}
+
+// caDB is the on-disk list of issued certificates
+type caDB struct {
+	CRLNumber int64         `json:"crl_number"`
+	Certs     []*IssuedCert `json:"certs"`
+}
+
+// CertAuthority is a small CA for client certificates of the edge proxy
+// and enrolled devices. Its root, key and records live in ca.dir.
+type CertAuthority struct {
+	config *Config
+	dir    string
+	root   *x509.Certificate
+	key    *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	certs     map[string]*IssuedCert
+	crlNumber int64
+	crl       []byte
+	crlTime   time.Time
+}
+
+// NewCertAuthority loads the CA from ca.dir, creating the root on first use
+func NewCertAuthority(cfg *Config) (*CertAuthority, error) {
+	ca := &CertAuthority{
+		config: cfg,
+		dir:    cfg.CA.Dir,
+		certs:  make(map[string]*IssuedCert),
+	}
+	if err := moveFromStateDir(cfg, "ca", ca.dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ca.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ca.loadRoot(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(ca.dbPath())
+	if err == nil {
+		var db caDB
+		if err := json.Unmarshal(data, &db); err != nil {
+			return nil, fmt.Errorf("failed to parse CA database: %w", err)
+		}
+		for _, c := range db.Certs {
+			ca.certs[c.Serial] = c
+		}
+		ca.crlNumber = db.CRLNumber
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read CA database: %w", err)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if err := ca.signCRL(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+func (ca *CertAuthority) dbPath() string {
+	return filepath.Join(ca.dir, "issued.json")
+}
+
+// loadRoot reads the root certificate and key, generating them if missing
+func (ca *CertAuthority) loadRoot() error {
+	certFile := filepath.Join(ca.dir, "ca-cert.pem")
+	keyFile := filepath.Join(ca.dir, "ca-key.pem")
+
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return ca.createRoot(certFile, keyFile)
+	}
+	if certErr != nil {
+		return fmt.Errorf("failed to read CA certificate: %w", certErr)
+	}
+	if keyErr != nil {
+		return fmt.Errorf("failed to read CA key: %w", keyErr)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("no certificate found in %s", certFile)
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("no key found in %s", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA key: %w", err)
+	}
+	if !key.PublicKey.Equal(root.PublicKey) {
+		return fmt.Errorf("CA key %s does not match %s", keyFile, certFile)
+	}
+	if time.Until(root.NotAfter) < 90*24*time.Hour {
+		tlsLog.Warn("Internal CA root expires soon", "expires", root.NotAfter.Format(time.RFC3339))
+	}
+
+	ca.root, ca.key = root, key
+	return nil
+}
+
+// createRoot generates a new root certificate and key
+func (ca *CertAuthority) createRoot(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"ctrlsrv"}, CommonName: ca.config.CA.CommonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caRootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	tlsLog.Info("Created internal CA", "name", ca.config.CA.CommonName, "sha256", certFingerprint(root))
+	ca.root, ca.key = root, key
+	return nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// certFingerprint returns the hex SHA-256 of a certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// save persists the issued certificate records. Caller holds ca.mu.
+func (ca *CertAuthority) save() error {
+	db := caDB{CRLNumber: ca.crlNumber, Certs: []*IssuedCert{}}
+	for _, c := range ca.certs {
+		db.Certs = append(db.Certs, c)
+	}
+	sort.Slice(db.Certs, func(i, j int) bool { return db.Certs[i].Issued.Before(db.Certs[j].Issued) })
+
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ca.dbPath(), data, 0600)
+}
+
+// signCRL re-signs the revocation list with a new number and writes it to
+// crl.pem for consumers that read it from disk. Caller holds ca.mu.
+func (ca *CertAuthority) signCRL() error {
+	var entries []x509.RevocationListEntry
+	now := time.Now()
+	for _, c := range ca.certs {
+		// Expired certificates are refused anyway and can leave the list
+		if c.Revoked.IsZero() || now.After(c.Expires) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(c.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: c.Revoked})
+	}
+
+	ca.crlNumber++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(ca.crlNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, ca.root, ca.key)
+	if err != nil {
+		return fmt.Errorf("failed to sign CRL: %w", err)
+	}
+	if err := ca.save(); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(ca.dir, "crl.pem"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	ca.crl, ca.crlTime = der, now
+	return nil
+}
+
+// Root returns the CA certificate
+func (ca *CertAuthority) Root() *x509.Certificate {
+	return ca.root
+}
+
+// CRL returns the current DER-encoded revocation list, re-signing it once
+// a day so it never reaches its NextUpdate
+func (ca *CertAuthority) CRL() ([]byte, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if time.Since(ca.crlTime) > crlRefresh {
+		if err := ca.signCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return ca.crl, nil
+}
+
+// List returns all issued certificates, newest first
+func (ca *CertAuthority) List() []IssuedCert {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	list := make([]IssuedCert, 0, len(ca.certs))
+	for _, c := range ca.certs {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Issued.After(list[j].Issued) })
+	return list
+}
+
+// Issue creates a client certificate for name. role, if set, is granted to
+// requests made with the certificate. A non-empty password also produces
+// a PKCS#12 bundle for import on phones.
+func (ca *CertAuthority) Issue(name string, role Role, validity time.Duration, password string) (*IssuedBundle, error) {
+	if !validUsername(name) {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	if role != "" && !validRole(role) {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+	if validity <= 0 {
+		validity = ca.config.CA.ClientValidity
+	}
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(ca.root.NotAfter) {
+		notAfter = ca.root.NotAfter
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"ctrlsrv"}, CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.root, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &IssuedBundle{
+		Certificate: IssuedCert{
+			Serial:      cert.SerialNumber.Text(16),
+			Name:        name,
+			Role:        role,
+			Fingerprint: certFingerprint(cert),
+			Issued:      time.Now(),
+			Expires:     cert.NotAfter,
+		},
+		CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+	if password != "" {
+		// The legacy encoding is the one iOS and older Android import
+		bundle.P12, err = pkcs12.Legacy.Encode(key, cert, []*x509.Certificate{ca.root}, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode PKCS#12: %w", err)
+		}
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	record := bundle.Certificate
+	ca.certs[record.Serial] = &record
+	if err := ca.save(); err != nil {
+		delete(ca.certs, record.Serial)
+		return nil, err
+	}
+
+	tlsLog.Info("Issued client certificate", "name", name, "serial", record.Serial, "expires", record.Expires.Format("2006-01-02"))
+	return bundle, nil
+}
+
+// Revoke marks a certificate as revoked and publishes a new CRL
+func (ca *CertAuthority) Revoke(serial string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	c, ok := ca.certs[serial]
+	if !ok {
+		return errCertNotFound
+	}
+	if !c.Revoked.IsZero() {
+		return nil
+	}
+	c.Revoked = time.Now()
+	if err := ca.signCRL(); err != nil {
+		c.Revoked = time.Time{}
+		return err
+	}
+
+	tlsLog.Info("Revoked client certificate", "name", c.Name, "serial", serial)
+	return nil
+}
+
+// Lookup returns the record for the leaf of a verified chain, or false if
+// the chain was not issued by this CA
+func (ca *CertAuthority) Lookup(chain []*x509.Certificate) (IssuedCert, bool) {
+	if len(chain) < 2 || !chain[len(chain)-1].Equal(ca.root) {
+		return IssuedCert{}, false
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	c, ok := ca.certs[chain[0].SerialNumber.Text(16)]
+	if !ok {
+		return IssuedCert{}, false
+	}
+	return *c, true
+}
+
+// Revoked reports whether any of the verified chains ends in a certificate
+// this CA has revoked. Certificates signed by this root but missing from
+// the records are treated as revoked, since the CA never issued them.
+func (ca *CertAuthority) Revoked(chains [][]*x509.Certificate) bool {
+	for _, chain := range chains {
+		if len(chain) < 2 || !chain[len(chain)-1].Equal(ca.root) {
+			continue
+		}
+		c, ok := ca.Lookup(chain)
+		if !ok || !c.Revoked.IsZero() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// usage prints help for the daemon flags and subcommands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n       %s [flags] config check\n\nFlags:\n", os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n  config check    Validate the config and print it with defaults applied\n")
+}
+
+// runCommand runs a subcommand instead of the daemon and returns the exit
+// code
+func runCommand(args []string) int {
+	switch {
+	case len(args) == 2 && args[0] == "config" && args[1] == "check":
+		return configCheck()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %v\n", args)
+		flag.Usage()
+		return 2
+	}
+}
+
+// configCheck resolves and loads the config the daemon would use, prints
+// the effective settings as YAML and reports whether they are valid
+func configCheck() int {
+	path, source, err := findConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	data, err := cfg.annotatedYAML()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode config: %v\n", err)
+		return 1
+	}
+	fmt.Printf("# Effective config from %s (%s); comments show where each value came from\n%s", path, source, data)
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid: %v\n", path, err)
+		return 1
+	}
+	for _, v := range cfg.Storage.Volumes {
+		if err := checkStorage(v.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: warning: volume %s: %v\n", path, v.Name, err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: OK\n", path)
+	return 0
+}
@@ -1,31 +1,65 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
-
-	"gopkg.in/yaml.v3"
+	"strings"
+	"time"
 )
 
 // Config represents the application configuration
 type Config struct {
-	Server    ServerConfig    `yaml:"server"`
-	Storage   StorageConfig   `yaml:"storage"`
-	CUPS      CUPSConfig      `yaml:"cups"`
-	Edge      EdgeConfig      `yaml:"edge"`
-	WireGuard WireGuardConfig `yaml:"wireguard"`
+	Server     ServerConfig     `yaml:"server"`
+	Storage    StorageConfig    `yaml:"storage"`
+	CUPS       CUPSConfig       `yaml:"cups"`
+	Edge       EdgeConfig       `yaml:"edge"`
+	WireGuard  WireGuardConfig  `yaml:"wireguard"`
+	Backup     BackupConfig     `yaml:"backup"`
+	Scrub      ScrubConfig      `yaml:"scrub"`
+	Removable  RemovableConfig  `yaml:"removable"`
+	Search     SearchConfig     `yaml:"search"`
+	Thumbnails ThumbnailsConfig `yaml:"thumbnails"`
+	Shares     SharesConfig     `yaml:"shares"`
+	Quotas     QuotasConfig     `yaml:"quotas"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Access     AccessConfig     `yaml:"access"`
+	MTLS       MTLSConfig       `yaml:"mtls"`
+	CA         CAConfig         `yaml:"ca"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	Audit      AuditConfig      `yaml:"audit"`
+
+	// path is the file the configuration was loaded from; sources maps
+	// settings to where their value came from, see loadConfigData
+	path    string
+	sources map[string]string
 }
 
 // ServerConfig contains server settings
 type ServerConfig struct {
-	ListenAddr string `yaml:"listen_addr"`
-	QUICAddr   string `yaml:"quic_addr"`
+	ListenAddr      string        `yaml:"listen_addr"`
+	QUICAddr        string        `yaml:"quic_addr"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	MetricsAddr     string        `yaml:"metrics_addr"`
 }
 
-// StorageConfig contains storage settings
+// StorageConfig contains storage settings. Path is the primary volume;
+// if Volumes is set, Path is taken from the volume with the primary role.
 type StorageConfig struct {
-	Path string `yaml:"path"`
+	Path    string         `yaml:"path"`
+	Volumes []VolumeConfig `yaml:"volumes"`
+}
+
+// VolumeConfig describes a single storage volume
+type VolumeConfig struct {
+	Name      string   `yaml:"name"`
+	Path      string   `yaml:"path"`
+	Role      string   `yaml:"role"`
+	Mandatory bool     `yaml:"mandatory"`
+	Services  []string `yaml:"services"`
 }
 
 // CUPSConfig contains CUPS printer settings
@@ -36,9 +70,12 @@ type CUPSConfig struct {
 
 // EdgeConfig contains edge proxy settings
 type EdgeConfig struct {
-	Endpoint string `yaml:"endpoint"`
-	TLSCert  string `yaml:"tls_cert"`
-	TLSKey   string `yaml:"tls_key"`
+	Endpoint   string `yaml:"endpoint"`
+	TLSCert    string `yaml:"tls_cert"`
+	TLSKey     string `yaml:"tls_key"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	CAFile     string `yaml:"ca_file"`
 }
 
 // WireGuardConfig contains WireGuard settings
@@ -47,58 +84,369 @@ type WireGuardConfig struct {
 	AllowedNetworks []string `yaml:"allowed_networks"`
 }
 
-// loadConfig loads configuration from file
-func loadConfig(path string) (*Config, error) {
-	// Determine config file path
-	if path == "" {
-		// Try config.yaml first, then config.example.yaml
-		if _, err := os.Stat("config.yaml"); err == nil {
-			path = "config.yaml"
-		} else if _, err := os.Stat("config.example.yaml"); err == nil {
-			path = "config.example.yaml"
-		} else {
-			return nil, fmt.Errorf("no config file found (tried config.yaml and config.example.yaml)")
+// BackupConfig contains backup settings
+type BackupConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Target    string        `yaml:"target"`
+	KeyFile   string        `yaml:"key_file"`
+	Paths     []string      `yaml:"paths"`
+	Interval  time.Duration `yaml:"interval"`
+	KeepLast  int           `yaml:"keep_last"`
+	KeepDaily int           `yaml:"keep_daily"`
+}
+
+// ScrubConfig contains integrity scrubbing settings. RateLimit is in bytes
+// per second; 0 turns the throttle off.
+type ScrubConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`
+	MaxAge    time.Duration `yaml:"max_age"`
+	RateLimit int64         `yaml:"rate_limit"`
+}
+
+// RemovableConfig contains removable media settings
+type RemovableConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	MountRoot       string   `yaml:"mount_root"`
+	ImportDir       string   `yaml:"import_dir"`
+	PhotoExtensions []string `yaml:"photo_extensions"`
+}
+
+// SearchConfig contains file search index settings
+type SearchConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	RescanInterval time.Duration `yaml:"rescan_interval"`
+}
+
+// ThumbnailsConfig contains thumbnail cache settings
+type ThumbnailsConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Pregenerate []string      `yaml:"pregenerate"`
+	MaxAge      time.Duration `yaml:"max_age"`
+}
+
+// SharesConfig contains share link settings. KeyFile holds the secret
+// share tokens are signed with; it must be outside the storage volume.
+type SharesConfig struct {
+	PublicURL  string        `yaml:"public_url"`
+	DefaultTTL time.Duration `yaml:"default_ttl"`
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+	KeyFile    string        `yaml:"key_file"`
+}
+
+// QuotasConfig contains per-share quota settings
+type QuotasConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Shares   []QuotaConfig `yaml:"shares"`
+}
+
+// QuotaConfig limits the size of a Samba share or top-level directory.
+// Limits are in bytes; 0 disables that limit.
+type QuotaConfig struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+	Soft int64  `yaml:"soft"`
+	Hard int64  `yaml:"hard"`
+}
+
+// AuthConfig contains authentication settings. Enabled defaults to true.
+// DBFile holds users,
+// sessions and API tokens; it must be outside the storage volume.
+type AuthConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	LocalRole  string        `yaml:"local_role"`
+	DBFile     string        `yaml:"db_file"`
+}
+
+// AccessConfig contains network access policies beyond the default
+// wireguard.allowed_networks
+type AccessConfig struct {
+	TrustedProxies []string            `yaml:"trusted_proxies"`
+	Groups         []AccessGroupConfig `yaml:"groups"`
+}
+
+// AccessGroupConfig restricts routes under the given path prefixes to networks
+type AccessGroupConfig struct {
+	Name     string   `yaml:"name"`
+	Prefixes []string `yaml:"prefixes"`
+	Networks []string `yaml:"networks"`
+}
+
+// MTLSConfig contains client certificate settings for the QUIC listener
+type MTLSConfig struct {
+	Enabled     bool                   `yaml:"enabled"`
+	CAFile      string                 `yaml:"ca_file"`
+	DefaultRole string                 `yaml:"default_role"`
+	Identities  []ClientIdentityConfig `yaml:"identities"`
+}
+
+// CAConfig contains settings for the built-in client certificate authority.
+// Dir holds its root key and records; it must be outside the storage volume.
+type CAConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	CommonName     string        `yaml:"common_name"`
+	ClientValidity time.Duration `yaml:"client_validity"`
+	Dir            string        `yaml:"dir"`
+}
+
+// LoggingConfig contains log settings. Subsystems overrides Level for
+// individual parts of the daemon, e.g. tunnel: debug.
+type LoggingConfig struct {
+	Level      string            `yaml:"level"`
+	Format     string            `yaml:"format"`
+	Subsystems map[string]string `yaml:"subsystems"`
+	BufferSize int               `yaml:"buffer_size"`
+}
+
+// AuditConfig contains audit log settings. KeyFile holds the key the log's
+// hash chain is signed with; it must be outside the storage volume.
+type AuditConfig struct {
+	KeyFile string `yaml:"key_file"`
+}
+
+// ClientIdentityConfig maps a client certificate name (CN or SAN) to a role
+type ClientIdentityConfig struct {
+	Match    string `yaml:"match"`
+	Username string `yaml:"username"`
+	Role     string `yaml:"role"`
+}
+
+// systemConfigPath is where packaged installs keep their configuration
+const systemConfigPath = "/etc/ctrlsrv/config.yaml"
+
+// secretsDir holds keys and credentials by default, off the storage volume
+const secretsDir = "/var/lib/ctrlsrv"
+
+// findConfig picks the config file: the -config flag, then $CONFIG_PATH,
+// then the first of /etc/ctrlsrv/config.yaml, config.yaml and
+// config.example.yaml that exists. A file named explicitly by the flag or
+// the environment must exist. It returns the path and where it came from.
+func findConfig(flagPath string) (string, string, error) {
+	if flagPath != "" {
+		return flagPath, "-config flag", nil
+	}
+	if env := os.Getenv("CONFIG_PATH"); env != "" {
+		return env, "CONFIG_PATH", nil
+	}
+	for _, candidate := range []struct{ path, source string }{
+		{systemConfigPath, "system default"},
+		{"config.yaml", "working directory"},
+		{"config.example.yaml", "example config"},
+	} {
+		if _, err := os.Stat(candidate.path); err == nil {
+			return candidate.path, candidate.source, nil
 		}
 	}
+	return "", "", fmt.Errorf("no config file found (tried %s, config.yaml and config.example.yaml; set -config or CONFIG_PATH)", systemConfigPath)
+}
 
+// loadConfig loads configuration from file
+func loadConfig(path string) (*Config, error) {
 	// Read file
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	// Parse YAML
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
-	}
+	return loadConfigData(path, data)
+}
 
-	// Set defaults
-	if cfg.Server.ListenAddr == "" {
-		cfg.Server.ListenAddr = "0.0.0.0:8080"
+// setDefaults fills in settings left empty
+func (c *Config) setDefaults() {
+	if c.Server.ListenAddr == "" {
+		c.Server.ListenAddr = "0.0.0.0:8080"
 	}
-	if cfg.Storage.Path == "" {
-		cfg.Storage.Path = "/srv/storage1"
+	for _, v := range c.Storage.Volumes {
+		if v.Role == VolumeRolePrimary {
+			c.Storage.Path = v.Path
+		}
 	}
-	if cfg.CUPS.URL == "" {
-		cfg.CUPS.URL = "http://localhost:631"
+	if c.Storage.Path == "" {
+		c.Storage.Path = "/srv/storage1"
 	}
-	if cfg.WireGuard.Interface == "" {
-		cfg.WireGuard.Interface = "wg0"
+	if len(c.Storage.Volumes) == 0 {
+		// Legacy single-path configuration
+		c.Storage.Volumes = []VolumeConfig{{
+			Name:      "storage1",
+			Path:      c.Storage.Path,
+			Role:      VolumeRolePrimary,
+			Mandatory: true,
+		}}
+	}
+	if c.CUPS.URL == "" {
+		c.CUPS.URL = "http://localhost:631"
+	}
+	if c.WireGuard.Interface == "" {
+		c.WireGuard.Interface = "wg0"
+	}
+	if c.Backup.Interval == 0 {
+		c.Backup.Interval = 24 * time.Hour
+	}
+	if len(c.Backup.Paths) == 0 {
+		c.Backup.Paths = []string{"."}
+	}
+	if c.Scrub.Interval == 0 {
+		c.Scrub.Interval = 24 * time.Hour
+	}
+	if c.Scrub.MaxAge == 0 {
+		c.Scrub.MaxAge = 30 * 24 * time.Hour
+	}
+	// An explicit 0 turns the throttle off
+	if _, set := c.sources["scrub.rate_limit"]; !set && c.Scrub.RateLimit == 0 {
+		c.Scrub.RateLimit = 20 << 20
+	}
+	if c.Removable.MountRoot == "" {
+		c.Removable.MountRoot = "/media/ctrlsrv"
+	}
+	if c.Removable.ImportDir == "" {
+		c.Removable.ImportDir = "imports"
+	}
+	if c.Search.RescanInterval == 0 {
+		c.Search.RescanInterval = time.Hour
+	}
+	if c.Thumbnails.Pregenerate == nil {
+		c.Thumbnails.Pregenerate = []string{"printdrop", "scans"}
+	}
+	if c.Thumbnails.MaxAge == 0 {
+		c.Thumbnails.MaxAge = 30 * 24 * time.Hour
+	}
+	if c.Shares.DefaultTTL == 0 {
+		c.Shares.DefaultTTL = 24 * time.Hour
+	}
+	if c.Shares.MaxTTL == 0 {
+		c.Shares.MaxTTL = 30 * 24 * time.Hour
+	}
+	if c.Shares.KeyFile == "" {
+		c.Shares.KeyFile = filepath.Join(secretsDir, "shares.key")
+	}
+	// Login is required unless turned off explicitly; the first start
+	// creates an admin account to log in with
+	if _, set := c.sources["auth.enabled"]; !set {
+		c.Auth.Enabled = true
+	}
+	if c.Auth.SessionTTL == 0 {
+		c.Auth.SessionTTL = 7 * 24 * time.Hour
+	}
+	if c.Auth.DBFile == "" {
+		c.Auth.DBFile = filepath.Join(secretsDir, "auth.json")
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 30 * time.Second
+	}
+	if c.CA.CommonName == "" {
+		c.CA.CommonName = "ctrlsrv CA"
+	}
+	if c.CA.ClientValidity == 0 {
+		c.CA.ClientValidity = 365 * 24 * time.Hour
+	}
+	if c.CA.Dir == "" {
+		c.CA.Dir = filepath.Join(secretsDir, "ca")
+	}
+	if c.Quotas.Interval == 0 {
+		c.Quotas.Interval = 15 * time.Minute
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "text"
+	}
+	if c.Logging.BufferSize == 0 {
+		c.Logging.BufferSize = 1000
+	}
+	if c.Audit.KeyFile == "" {
+		c.Audit.KeyFile = "/etc/ctrlsrv/audit.key"
+	}
+	if len(c.Removable.PhotoExtensions) == 0 {
+		c.Removable.PhotoExtensions = []string{".jpg", ".jpeg", ".png", ".heic", ".raw", ".dng", ".cr2", ".nef", ".mp4", ".mov"}
 	}
-
-	return &cfg, nil
 }
 
-// Validate checks if the configuration is valid
+// Validate checks if the configuration is valid. Whether the storage
+// volumes are present is not checked here: a missing disk is reported as a
+// health alert, and mandatory volumes are checked at startup.
 func (c *Config) Validate() error {
-	// Check storage path exists
-	if c.Storage.Path != "" {
-		if _, err := os.Stat(c.Storage.Path); os.IsNotExist(err) {
-			return fmt.Errorf("storage path does not exist: %s", c.Storage.Path)
+	if err := validateVolumes(c.Storage.Volumes); err != nil {
+		return err
+	}
+
+	// Backups must not land on the disk they protect
+	if c.Backup.Enabled {
+		if c.Backup.Target == "" {
+			return fmt.Errorf("backup enabled but no target configured")
+		}
+		if c.Backup.KeyFile == "" {
+			return fmt.Errorf("backup enabled but no key_file configured")
+		}
+		rel, err := filepath.Rel(c.Storage.Path, c.Backup.Target)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("backup target must be outside storage path: %s", c.Backup.Target)
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, q := range c.Quotas.Shares {
+		if q.Name == "" || names[q.Name] {
+			return fmt.Errorf("quota for %q needs a unique name", q.Path)
+		}
+		names[q.Name] = true
+		if _, err := resolveStoragePath(c.Storage.Path, q.Path); err != nil {
+			return fmt.Errorf("quota %s: %w", q.Name, err)
+		}
+		if q.Soft < 0 || q.Hard < 0 || (q.Hard > 0 && q.Soft > q.Hard) {
+			return fmt.Errorf("quota %s: soft limit must not exceed hard limit", q.Name)
+		}
+	}
+
+	if _, err := NewAccessControl(c); err != nil {
+		return err
+	}
+
+	if c.Auth.LocalRole != "" && !validRole(Role(c.Auth.LocalRole)) {
+		return fmt.Errorf("invalid auth.local_role: %q", c.Auth.LocalRole)
+	}
+
+	if c.MTLS.Enabled {
+		if c.MTLS.CAFile == "" && !c.CA.Enabled {
+			return fmt.Errorf("mtls enabled but no ca_file configured and the internal ca is disabled")
+		}
+		if c.MTLS.CAFile != "" {
+			if _, err := loadClientCAs(c.MTLS.CAFile); err != nil {
+				return err
+			}
+		}
+	}
+	if c.MTLS.DefaultRole != "" && !validRole(Role(c.MTLS.DefaultRole)) {
+		return fmt.Errorf("invalid mtls.default_role: %q", c.MTLS.DefaultRole)
+	}
+	for _, id := range c.MTLS.Identities {
+		if id.Match == "" || (id.Role != "" && !validRole(Role(id.Role))) {
+			return fmt.Errorf("invalid mtls identity %q", id.Match)
 		}
 	}
 
+	if err := validateLogging(c.Logging); err != nil {
+		return err
+	}
+
+	// Keys and credentials on the storage volume could be read through
+	// Samba, removable imports or a backup of it
+	for _, s := range []struct{ key, path string }{
+		{"audit.key_file", c.Audit.KeyFile},
+		{"auth.db_file", c.Auth.DBFile},
+		{"shares.key_file", c.Shares.KeyFile},
+		{"ca.dir", c.CA.Dir},
+	} {
+		if rel, err := filepath.Rel(c.Storage.Path, s.path); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("%s must be outside storage path: %s", s.key, s.path)
+		}
+	}
+
+	if (c.Edge.TLSCert == "") != (c.Edge.TLSKey == "") {
+		return fmt.Errorf("edge.tls_cert and edge.tls_key must be set together")
+	}
+
 	// Check TLS files if edge is configured
 	if c.Edge.Endpoint != "" {
 		if c.Edge.TLSCert != "" {
@@ -111,6 +459,20 @@ func (c *Config) Validate() error {
 				return fmt.Errorf("TLS key not found: %s", c.Edge.TLSKey)
 			}
 		}
+		if _, _, err := net.SplitHostPort(c.Edge.Endpoint); err != nil {
+			return fmt.Errorf("invalid edge.endpoint: %w", err)
+		}
+		if c.Edge.ClientCert == "" || c.Edge.ClientKey == "" {
+			return fmt.Errorf("edge.client_cert and edge.client_key are required for the edge tunnel")
+		}
+		if _, err := tls.LoadX509KeyPair(c.Edge.ClientCert, c.Edge.ClientKey); err != nil {
+			return fmt.Errorf("invalid edge client certificate: %w", err)
+		}
+		if c.Edge.CAFile != "" {
+			if _, err := loadClientCAs(c.Edge.CAFile); err != nil {
+				return fmt.Errorf("edge.ca_file: %w", err)
+			}
+		}
 	}
 
 	return nil
@@ -120,3 +482,69 @@ func (c *Config) Validate() error {
 func (c *Config) GetPrintDropPath() string {
 	return filepath.Join(c.Storage.Path, "printdrop")
 }
+
+// GetStateDir returns the hidden directory for ctrlsrv state on the storage volume
+func (c *Config) GetStateDir() string {
+	return filepath.Join(c.Storage.Path, ".ctrlsrv")
+}
+
+// GetTrashDir returns where files removed through the web UI are kept
+func (c *Config) GetTrashDir() string {
+	return filepath.Join(c.GetStateDir(), "trash")
+}
+
+// moveFromStateDir moves name, which older versions kept in the state
+// directory on storage, to dst unless dst already exists
+func moveFromStateDir(cfg *Config, name, dst string) error {
+	src := filepath.Join(cfg.GetStateDir(), name)
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(src); err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		// Usually a different filesystem: copy, then remove the original
+		if err := copyTree(src, dst); err != nil {
+			os.RemoveAll(dst)
+			return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+		}
+		if err := os.RemoveAll(src); err != nil {
+			return err
+		}
+	}
+	configLog.Info("Moved out of the storage volume", "from", src, "to", dst)
+	return nil
+}
+
+// copyTree copies a file, or a directory of files, keeping permissions
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(target, data, info.Mode().Perm())
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configHistoryKeep is how many previous versions of the config file are kept
+const configHistoryKeep = 20
+
+var (
+	errConfigConflict = errors.New("config file changed since it was loaded; reload and try again")
+	errConfigVersion  = errors.New("config version not found")
+	errConfigInvalid  = errors.New("invalid config")
+)
+
+// ConfigFile is the config file as stored on disk. Overrides lists the
+// running settings that come from conf.d fragments, the environment or
+// secret files rather than this file.
+type ConfigFile struct {
+	Path      string            `json:"path"`
+	Hash      string            `json:"hash"`
+	YAML      string            `json:"yaml"`
+	History   []ConfigVersion   `json:"history"`
+	Overrides map[string]string `json:"overrides"`
+}
+
+// ConfigVersion is a previous version of the config file, saved before it
+// was replaced through the API
+type ConfigVersion struct {
+	Version string    `json:"version"`
+	Saved   time.Time `json:"saved"`
+	Size    int64     `json:"size"`
+}
+
+// ConfigPreview lists what saving a config file would change. Changes to
+// the settings in RestartRequired only take effect after a restart.
+type ConfigPreview struct {
+	Changes         []ConfigChange `json:"changes"`
+	RestartRequired []string       `json:"restart_required"`
+}
+
+// configHash identifies a version of the config file so concurrent edits
+// are detected
+func configHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkConfigSchema rejects YAML with unknown keys or values of the wrong
+// type, which loading would silently ignore. Files named by <name>_file
+// keys are resolved against dir.
+func checkConfigSchema(data []byte, dir string) error {
+	// Resolve <name>_file keys first; they are not fields of Config
+	root, err := parseConfigNode(data, "config", dir, nil)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return fmt.Errorf("config is empty")
+	}
+	resolved, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(resolved))
+	dec.KnownFields(true)
+	var cfg Config
+	return dec.Decode(&cfg)
+}
+
+// configHistoryDir holds previous versions of the config file
+func (c *Config) configHistoryDir() string {
+	return filepath.Join(c.GetStateDir(), "config-history")
+}
+
+// ConfigFile returns the current config file and its saved versions
+func (s *APIServer) ConfigFile() (ConfigFile, error) {
+	cfg := s.config.Load()
+	data, err := os.ReadFile(cfg.path)
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	history, err := s.configHistory()
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	return ConfigFile{Path: cfg.path, Hash: configHash(data), YAML: string(data), History: history, Overrides: cfg.Overrides()}, nil
+}
+
+// configHistory lists saved versions, newest first
+func (s *APIServer) configHistory() ([]ConfigVersion, error) {
+	entries, err := os.ReadDir(s.config.Load().configHistoryDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	history := []ConfigVersion{}
+	for _, e := range entries {
+		version, ok := strings.CutSuffix(e.Name(), ".yaml")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		history = append(history, ConfigVersion{Version: version, Saved: info.ModTime(), Size: info.Size()})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Version > history[j].Version })
+	return history, nil
+}
+
+// ConfigFileVersion returns the contents of a saved version
+func (s *APIServer) ConfigFileVersion(version string) ([]byte, error) {
+	history, err := s.configHistory()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range history {
+		if v.Version == version {
+			return os.ReadFile(filepath.Join(s.config.Load().configHistoryDir(), version+".yaml"))
+		}
+	}
+	return nil, errConfigVersion
+}
+
+// PreviewConfig validates a new config file and compares it with the
+// running configuration
+func (s *APIServer) PreviewConfig(data []byte) (ConfigPreview, error) {
+	next, err := s.checkConfig(data)
+	if err != nil {
+		return ConfigPreview{}, err
+	}
+	cur := s.config.Load()
+	changes := configChanges(cur, next)
+	for i, c := range changes {
+		if isSecretSource(cur.Source(c.Path)) || isSecretSource(next.Source(c.Path)) {
+			changes[i].Old, changes[i].New = secretMask, secretMask
+		}
+	}
+	return ConfigPreview{
+		Changes:         changes,
+		RestartRequired: configDiff(applyReloadable(cur, next), next),
+	}, nil
+}
+
+// checkConfig parses and validates a new config file
+func (s *APIServer) checkConfig(data []byte) (*Config, error) {
+	if err := checkConfigSchema(data, filepath.Dir(s.config.Load().path)); err != nil {
+		return nil, fmt.Errorf("%w: %v", errConfigInvalid, err)
+	}
+	next, err := loadConfigData(s.config.Load().path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errConfigInvalid, err)
+	}
+	if err := next.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errConfigInvalid, err)
+	}
+	return next, nil
+}
+
+// ApplyConfig replaces the config file and reloads it. base is the hash of
+// the file the edit started from. Configs that would stop client from
+// reaching path are refused. The previous file is saved to the history
+// first and restored if the reload fails or a probe of the settings it can
+// change fails that passed before.
+func (s *APIServer) ApplyConfig(data []byte, base string, client net.IP, forwarded bool, path string) (ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, err := s.checkConfig(data)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if access, err := NewAccessControl(next); err == nil && client != nil && !access.policyFor(path).allows(client, forwarded) {
+		return ReloadResult{}, fmt.Errorf("%w: the new access rules would lock out %s", errConfigInvalid, client)
+	}
+	cfg := s.config.Load()
+	// Write through symlinks rather than replacing them
+	file, err := filepath.EvalSymlinks(cfg.path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	old, err := os.ReadFile(file)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if configHash(old) != base {
+		return ReloadResult{}, errConfigConflict
+	}
+
+	if err := s.saveConfigVersion(old, info.Mode().Perm()); err != nil {
+		return ReloadResult{}, fmt.Errorf("failed to save previous config: %w", err)
+	}
+	before := s.probeConfig(cfg, client, forwarded, path)
+	if err := writeFileAtomic(file, data, info.Mode().Perm()); err != nil {
+		return ReloadResult{}, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	result, err := s.reload()
+	if err == nil {
+		after := s.probeConfig(s.config.Load(), client, forwarded, path)
+		for _, name := range slices.Sorted(maps.Keys(after)) {
+			if before[name] == nil && after[name] != nil {
+				err = fmt.Errorf("%s: %w", name, after[name])
+				break
+			}
+		}
+	}
+	if err != nil {
+		configLog.Error("New config failed, rolling back", "error", err)
+		if werr := writeFileAtomic(file, old, info.Mode().Perm()); werr != nil {
+			return ReloadResult{}, fmt.Errorf("%w; restoring previous config failed: %v", err, werr)
+		}
+		if _, rerr := s.reload(); rerr != nil {
+			return ReloadResult{}, fmt.Errorf("%w; reloading previous config failed: %v", err, rerr)
+		}
+		return ReloadResult{}, fmt.Errorf("%w: %v; previous config restored", errConfigInvalid, err)
+	}
+	configLog.Info("Config file updated through the API", "path", cfg.path)
+	return result, nil
+}
+
+// probeConfig checks that the settings a reload can change work with cfg,
+// keyed by config section: CUPS is reachable, the access rules still let
+// client reach path, the share store loads and the mTLS client CAs load
+func (s *APIServer) probeConfig(cfg *Config, client net.IP, forwarded bool, path string) map[string]error {
+	probes := make(map[string]error)
+
+	cups := &http.Client{Timeout: 3 * time.Second}
+	if resp, err := cups.Get(cfg.CUPS.URL); err != nil {
+		probes["cups"] = fmt.Errorf("CUPS unreachable: %w", err)
+	} else {
+		resp.Body.Close()
+		probes["cups"] = nil
+	}
+
+	access, err := NewAccessControl(cfg)
+	if err == nil && client != nil && !access.policyFor(path).allows(client, forwarded) {
+		err = fmt.Errorf("%s is locked out", client)
+	}
+	probes["access"] = err
+
+	probes["shares"] = s.shares.Check(cfg)
+	probes["mtls"] = configureClientAuth(cfg, &tls.Config{}, s.ca)
+	return probes
+}
+
+// saveConfigVersion adds data to the history and prunes old versions.
+// Caller holds s.reloadMu.
+func (s *APIServer) saveConfigVersion(data []byte, perm os.FileMode) error {
+	dir := s.config.Load().configHistoryDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	version := time.Now().UTC().Format("20060102-150405.000")
+	if err := writeFileAtomic(filepath.Join(dir, version+".yaml"), data, perm); err != nil {
+		return err
+	}
+
+	history, err := s.configHistory()
+	if err != nil {
+		return err
+	}
+	for i := configHistoryKeep; i < len(history); i++ {
+		os.Remove(filepath.Join(dir, history[i].Version+".yaml"))
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts environment variables that override config settings,
+// e.g. CTRLSRV_CUPS_PRINTER for cups.printer
+const envPrefix = "CTRLSRV_"
+
+// sourceDefault is the source of settings nobody set
+const sourceDefault = "default"
+
+// secretMask replaces values read from secret files wherever config is shown
+const secretMask = "********"
+
+// configField is a setting that can be overridden on its own: a value, or
+// a list as a whole
+type configField struct {
+	path  string
+	index []int
+	kind  reflect.Kind
+}
+
+// configFields lists every setting of Config by YAML path
+func configFields() []configField {
+	var fields []configField
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			idx := append(append([]int(nil), index...), i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, name, idx)
+			} else {
+				fields = append(fields, configField{path: name, index: idx, kind: f.Type.Kind()})
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "", nil)
+	return fields
+}
+
+// envName returns the environment variable that overrides a setting
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// configRelPath resolves a file named in the configuration. Relative paths
+// are taken from dir, the directory of the config file, so they do not
+// depend on where the daemon was started.
+func configRelPath(dir, path string) string {
+	if filepath.IsAbs(path) || dir == "" {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// readSecretFile reads a value kept in its own file, without the trailing
+// newline editors add
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadConfigData builds the configuration from data, the contents of the
+// file at path. Fragments in the conf.d directory next to it are merged
+// over it in name order, then CTRLSRV_ environment variables, then defaults
+// fill in the rest. Where each setting came from is recorded for
+// Config.Source.
+func loadConfigData(path string, data []byte) (*Config, error) {
+	cfg := &Config{path: path, sources: make(map[string]string)}
+	if err := cfg.mergeYAML(data, path); err != nil {
+		return nil, err
+	}
+
+	fragments, err := configFragments(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fragments {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config fragment: %w", err)
+		}
+		if err := cfg.mergeYAML(data, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.mergeEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	return cfg, nil
+}
+
+// configFragments lists the YAML files in the conf.d directory next to the
+// config file, in the order they are merged
+func configFragments(path string) ([]string, error) {
+	dir := filepath.Join(filepath.Dir(path), "conf.d")
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config fragments: %w", err)
+	}
+	var fragments []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		fragments = append(fragments, filepath.Join(dir, e.Name()))
+	}
+	return fragments, nil
+}
+
+// parseConfigNode parses a YAML document and replaces "<name>_file" keys
+// with the contents of the file they point to, for string settings that
+// have no real <name>_file setting; relative paths are resolved against
+// dir. It returns nil for an empty document. The settings found are
+// recorded in sources if it is not nil.
+func parseConfigNode(data []byte, source, dir string, sources map[string]string) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if err := walkConfigNode(root, reflect.TypeOf(Config{}), "", source, dir, sources); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	return root, nil
+}
+
+func walkConfigNode(node *yaml.Node, t reflect.Type, prefix, source, dir string, sources map[string]string) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if t.Field(i).IsExported() && name != "" && name != "-" {
+			fields[name] = t.Field(i)
+		}
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		field, ok := fields[key.Value]
+		src := source
+		if name, isFile := strings.CutSuffix(key.Value, "_file"); !ok && isFile {
+			if field, ok = fields[name]; !ok || field.Type.Kind() != reflect.String {
+				continue
+			}
+			file := configRelPath(dir, value.Value)
+			secret, err := readSecretFile(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key.Value, err)
+			}
+			src = fmt.Sprintf("file %s (%s)", file, source)
+			key.Value = name
+			*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: secret}
+		}
+		if !ok {
+			continue
+		}
+
+		path := key.Value
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := walkConfigNode(value, field.Type, path, source, dir, sources); err != nil {
+				return err
+			}
+		} else if sources != nil {
+			sources[path] = src
+		}
+	}
+	return nil
+}
+
+// mergeYAML merges a YAML document over c. Lists replace earlier values
+// rather than being appended to.
+func (c *Config) mergeYAML(data []byte, source string) error {
+	root, err := parseConfigNode(data, source, filepath.Dir(c.path), c.sources)
+	if err != nil || root == nil {
+		return err
+	}
+	if err := root.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+	return nil
+}
+
+// mergeEnv applies CTRLSRV_ variables from environ. Values are parsed as
+// YAML, so lists can be given as "[a, b]"; CTRLSRV_<NAME>_FILE reads a
+// string setting from a file, relative to the config file's directory.
+// Unknown variables are logged and ignored, so a stale one left in the
+// environment file does not stop the daemon.
+func (c *Config) mergeEnv(environ []string) error {
+	fields := make(map[string]configField)
+	for _, f := range configFields() {
+		fields[envName(f.path)] = f
+	}
+
+	sort.Strings(environ)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		field, ok := fields[name]
+		src := "env " + name
+		if base, isFile := strings.CutSuffix(name, "_FILE"); !ok && isFile {
+			if field, ok = fields[base]; ok && field.kind != reflect.String {
+				ok = false
+			} else if ok {
+				file := configRelPath(filepath.Dir(c.path), value)
+				secret, err := readSecretFile(file)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				src = fmt.Sprintf("file %s (env %s)", file, name)
+				value = secret
+			}
+		}
+		if !ok {
+			configLog.Warn("Ignoring unknown config override", "variable", name)
+			continue
+		}
+
+		v := reflect.ValueOf(c).Elem().FieldByIndex(field.index)
+		if field.kind == reflect.String {
+			v.SetString(value)
+		} else {
+			parsed := reflect.New(v.Type())
+			if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			v.Set(parsed.Elem())
+		}
+		c.sources[field.path] = src
+	}
+	return nil
+}
+
+// Source reports where a setting came from: a config file or fragment,
+// an environment variable, a secret file, or the default
+func (c *Config) Source(path string) string {
+	if src, ok := c.sources[path]; ok {
+		return src
+	}
+	return sourceDefault
+}
+
+// Overrides lists the settings that do not come from the config file
+// itself or defaults, with their source
+func (c *Config) Overrides() map[string]string {
+	overrides := make(map[string]string)
+	for path, src := range c.sources {
+		if src != c.path {
+			overrides[path] = src
+		}
+	}
+	return overrides
+}
+
+// isSecretSource reports whether a value was read from a secret file
+func isSecretSource(src string) bool {
+	return strings.HasPrefix(src, "file ")
+}
+
+// annotatedYAML renders c with the source of each setting as a comment.
+// Values read from secret files are masked.
+func (c *Config) annotatedYAML() ([]byte, error) {
+	var root yaml.Node
+	if err := root.Encode(c); err != nil {
+		return nil, err
+	}
+	c.annotateNode(&root, reflect.TypeOf(Config{}), "")
+
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return []byte(buf.String()), nil
+}
+
+func (c *Config) annotateNode(node *yaml.Node, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if !t.Field(i).IsExported() || name == "" || name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			key, value := node.Content[j], node.Content[j+1]
+			if key.Value != name {
+				continue
+			}
+			if t.Field(i).Type.Kind() == reflect.Struct {
+				c.annotateNode(value, t.Field(i).Type, path)
+				break
+			}
+			src := c.Source(path)
+			if isSecretSource(src) {
+				*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: secretMask}
+			}
+			if value.Kind == yaml.ScalarNode {
+				value.LineComment = src
+			} else {
+				key.LineComment = src
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// duplicatePartialSize is how much of each file is hashed before deciding
+// whether a full hash is worth computing
+const duplicatePartialSize = 64 << 10
+
+// Duplicate actions
+const (
+	DuplicateActionTrash    = "trash"
+	DuplicateActionHardlink = "hardlink"
+)
+
+// DuplicateFinder finds files with identical content below a storage path.
+// Candidates are grouped by size, then by a hash of their first 64 KiB, and
+// finally by a full SHA-256 so only plausible duplicates are read in full.
+// Files that are already hardlinked to each other count as one.
+type DuplicateFinder struct {
+	config *Config
+
+	mu      sync.Mutex
+	status  DuplicateStatus
+	running sync.WaitGroup
+}
+
+// DuplicateStatus reports progress and results of the last scan
+type DuplicateStatus struct {
+	Running  bool             `json:"running"`
+	Path     string           `json:"path"`
+	MinSize  int64            `json:"min_size"`
+	Started  time.Time        `json:"started,omitempty"`
+	Finished time.Time        `json:"finished,omitempty"`
+	Scanned  int              `json:"scanned_files"`
+	Hashed   int              `json:"hashed_files"`
+	Wasted   uint64           `json:"wasted_bytes"`
+	Error    string           `json:"error,omitempty"`
+	Groups   []DuplicateGroup `json:"groups"`
+}
+
+// DuplicateGroup is a set of files with identical content
+type DuplicateGroup struct {
+	Hash  string          `json:"hash"`
+	Size  int64           `json:"size"`
+	Files []DuplicateFile `json:"files"`
+}
+
+// DuplicateFile is one member of a duplicate group
+type DuplicateFile struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// DuplicateActionResult reports the outcome of a bulk action
+type DuplicateActionResult struct {
+	Done   []string `json:"done"`
+	Errors []string `json:"errors"`
+	Freed  uint64   `json:"freed_bytes"`
+}
+
+// NewDuplicateFinder creates a new duplicate finder
+func NewDuplicateFinder(cfg *Config) *DuplicateFinder {
+	return &DuplicateFinder{
+		config: cfg,
+		status: DuplicateStatus{Groups: []DuplicateGroup{}},
+	}
+}
+
+// Status returns a copy of the current status
+func (d *DuplicateFinder) Status() DuplicateStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status
+	status.Groups = append([]DuplicateGroup{}, d.status.Groups...)
+	return status
+}
+
+// Start begins a background scan of rel (relative to storage) that stops
+// when ctx is cancelled
+func (d *DuplicateFinder) Start(ctx context.Context, rel string, minSize int64) error {
+	root, err := resolveUserPath(d.config, rel)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", rel)
+	}
+
+	d.mu.Lock()
+	if d.status.Running {
+		d.mu.Unlock()
+		return fmt.Errorf("a duplicate scan is already running")
+	}
+	d.status = DuplicateStatus{
+		Running: true,
+		Path:    rel,
+		MinSize: minSize,
+		Started: time.Now(),
+		Groups:  []DuplicateGroup{},
+	}
+	d.mu.Unlock()
+
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		groups, err := d.scan(ctx, root, minSize)
+
+		d.mu.Lock()
+		d.status.Running = false
+		d.status.Finished = time.Now()
+		if err != nil {
+			d.status.Error = err.Error()
+		} else {
+			d.setGroupsLocked(groups)
+		}
+		wasted := d.status.Wasted
+		d.mu.Unlock()
+
+		if err != nil {
+			storageLog.Error("Duplicate scan failed", "path", root, "error", err)
+			return
+		}
+		storageLog.Info("Duplicate scan complete", "path", root, "groups", len(groups), "reclaimable", formatBytes(wasted))
+	}()
+	return nil
+}
+
+// Wait blocks until a running scan has returned
+func (d *DuplicateFinder) Wait() {
+	d.running.Wait()
+}
+
+// setGroupsLocked stores groups sorted by reclaimable space. Caller holds d.mu.
+func (d *DuplicateFinder) setGroupsLocked(groups []DuplicateGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Size*int64(len(groups[i].Files)-1) > groups[j].Size*int64(len(groups[j].Files)-1)
+	})
+	d.status.Wasted = 0
+	for _, g := range groups {
+		d.status.Wasted += uint64(g.Size) * uint64(len(g.Files)-1)
+	}
+	d.status.Groups = groups
+}
+
+func (d *DuplicateFinder) scan(ctx context.Context, root string, minSize int64) ([]DuplicateGroup, error) {
+	type candidate struct {
+		path    string
+		rel     string
+		modTime time.Time
+	}
+
+	// Pass 1: group by size, skipping extra hardlinks to the same inode
+	bySize := make(map[int64][]candidate)
+	inodes := make(map[[2]uint64]bool)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if path != root && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() < max(minSize, 1) {
+			return nil
+		}
+		if key, ok := fileID(info); ok {
+			if inodes[key] {
+				return nil
+			}
+			inodes[key] = true
+		}
+		rel, err := filepath.Rel(d.config.Storage.Path, path)
+		if err != nil {
+			return nil
+		}
+
+		bySize[info.Size()] = append(bySize[info.Size()], candidate{path, filepath.ToSlash(rel), info.ModTime()})
+		d.mu.Lock()
+		d.status.Scanned++
+		d.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []DuplicateGroup{}
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+
+		// Pass 2: partial hash; pass 3: full hash of partial collisions
+		byPartial := make(map[string][]candidate)
+		for _, f := range files {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			sum, err := hashFilePrefix(f.path, duplicatePartialSize)
+			if err != nil {
+				continue
+			}
+			byPartial[sum] = append(byPartial[sum], f)
+		}
+
+		for _, partial := range byPartial {
+			if len(partial) < 2 {
+				continue
+			}
+			byFull := make(map[string][]candidate)
+			for _, f := range partial {
+				sum := ""
+				if size <= duplicatePartialSize {
+					// The partial hash already covered the whole file
+					sum, _ = hashFilePrefix(f.path, duplicatePartialSize)
+				} else {
+					var err error
+					if sum, _, err = hashFileThrottled(ctx, f.path, &scrubLimiter{}); err != nil {
+						if ctx.Err() != nil {
+							return nil, ctx.Err()
+						}
+						continue
+					}
+				}
+				d.mu.Lock()
+				d.status.Hashed++
+				d.mu.Unlock()
+				byFull[sum] = append(byFull[sum], f)
+			}
+
+			for sum, same := range byFull {
+				if len(same) < 2 {
+					continue
+				}
+				group := DuplicateGroup{Hash: sum, Size: size}
+				for _, f := range same {
+					group.Files = append(group.Files, DuplicateFile{Path: f.rel, ModTime: f.modTime})
+				}
+				// Oldest copy first: it is the default one to keep
+				sort.Slice(group.Files, func(i, j int) bool {
+					return group.Files[i].ModTime.Before(group.Files[j].ModTime)
+				})
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Apply keeps one file and either moves the listed duplicates to the trash
+// or replaces them with hardlinks to the kept file. Every file is re-hashed
+// first so nothing is removed if it changed since the scan.
+func (d *DuplicateFinder) Apply(ctx context.Context, action, keep string, remove []string) (*DuplicateActionResult, error) {
+	if action != DuplicateActionTrash && action != DuplicateActionHardlink {
+		return nil, fmt.Errorf("unknown action: %q", action)
+	}
+
+	d.mu.Lock()
+	if d.status.Running {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("a duplicate scan is running")
+	}
+	var group *DuplicateGroup
+	for i := range d.status.Groups {
+		for _, f := range d.status.Groups[i].Files {
+			if f.Path == keep {
+				group = &d.status.Groups[i]
+			}
+		}
+	}
+	var expected string
+	var size int64
+	members := make(map[string]bool)
+	if group != nil {
+		expected, size = group.Hash, group.Size
+		for _, f := range group.Files {
+			members[f.Path] = true
+		}
+	}
+	d.mu.Unlock()
+
+	if group == nil {
+		return nil, fmt.Errorf("%s is not part of a duplicate group", keep)
+	}
+
+	keepPath, err := resolveUserPath(d.config, keep)
+	if err != nil {
+		return nil, err
+	}
+	if sum, _, err := hashFileThrottled(ctx, keepPath, &scrubLimiter{}); err != nil || sum != expected {
+		return nil, fmt.Errorf("%s changed since the scan, rescan first", keep)
+	}
+
+	result := &DuplicateActionResult{Done: []string{}, Errors: []string{}}
+	for _, rel := range remove {
+		if rel == keep || !members[rel] {
+			result.Errors = append(result.Errors, rel+": not a duplicate of "+keep)
+			continue
+		}
+		path, err := resolveUserPath(d.config, rel)
+		if err != nil {
+			result.Errors = append(result.Errors, rel+": "+err.Error())
+			continue
+		}
+		if sum, _, err := hashFileThrottled(ctx, path, &scrubLimiter{}); err != nil || sum != expected {
+			result.Errors = append(result.Errors, rel+": changed since the scan")
+			continue
+		}
+
+		if action == DuplicateActionTrash {
+			err = d.moveToTrash(rel, path)
+		} else {
+			err = replaceWithHardlink(keepPath, path)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, rel+": "+err.Error())
+			continue
+		}
+		result.Done = append(result.Done, rel)
+		result.Freed += uint64(size)
+	}
+
+	storageLog.Info("Applied duplicate action", "action", action, "files", len(result.Done), "keep", keep, "freed", formatBytes(result.Freed))
+
+	// Drop handled files from the results
+	done := make(map[string]bool)
+	for _, rel := range result.Done {
+		done[rel] = true
+	}
+	d.mu.Lock()
+	groups := []DuplicateGroup{}
+	for _, g := range d.status.Groups {
+		files := []DuplicateFile{}
+		for _, f := range g.Files {
+			if !done[f.Path] {
+				files = append(files, f)
+			}
+		}
+		if len(files) > 1 {
+			g.Files = files
+			groups = append(groups, g)
+		}
+	}
+	d.setGroupsLocked(groups)
+	d.mu.Unlock()
+
+	return result, nil
+}
+
+// moveToTrash moves a file into a dated trash folder in the state directory,
+// preserving its relative path so it can be restored by hand
+func (d *DuplicateFinder) moveToTrash(rel, path string) error {
+	dest := filepath.Join(d.config.GetTrashDir(), time.Now().Format("2006-01-02"), filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		dest += "." + time.Now().Format("150405")
+	}
+	return os.Rename(path, dest)
+}
+
+// replaceWithHardlink atomically replaces path with a hardlink to keep
+func replaceWithHardlink(keep, path string) error {
+	tmp := path + ".ctrlsrv-link"
+	if err := os.Link(keep, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// hashFilePrefix returns the SHA-256 of the first n bytes of a file
+func hashFilePrefix(path string, n int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, n)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
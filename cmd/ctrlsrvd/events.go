@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventTopic is a piece of state pushed to the UI, sampled every interval
+// while anyone is subscribed to it
+type eventTopic struct {
+	name     string
+	interval time.Duration
+	sample   func() any
+}
+
+// Event is one update of a topic
+type Event struct {
+	ID    uint64
+	Topic string
+	Data  []byte
+}
+
+// eventSubscriber receives events for its topics. ch is closed when the
+// subscriber falls behind or the bus shuts down; the client then
+// reconnects and starts again from a snapshot.
+type eventSubscriber struct {
+	topics map[string]bool
+	ch     chan Event
+}
+
+// EventBus samples subsystem state in one place and pushes changes to
+// subscribers, so open pages do not each poll and repeat the same storage
+// checks and systemctl calls
+type EventBus struct {
+	topics []eventTopic
+
+	mu      sync.Mutex
+	seq     uint64
+	last    map[string]Event
+	sampled map[string]time.Time
+	subs    map[*eventSubscriber]bool
+	closed  bool
+}
+
+// NewEventBus creates an event bus for the given topics
+func NewEventBus(topics []eventTopic) *EventBus {
+	return &EventBus{
+		topics:  topics,
+		last:    make(map[string]Event),
+		sampled: make(map[string]time.Time),
+		subs:    make(map[*eventSubscriber]bool),
+	}
+}
+
+// Run samples due topics until ctx is cancelled
+func (b *EventBus) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		for _, t := range b.due() {
+			b.Publish(t.name, t.sample())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// due returns the topics that have subscribers and were last sampled at
+// least their interval ago. Values of topics nobody watches are dropped so
+// the next subscriber does not get a stale snapshot.
+func (b *EventBus) due() []eventTopic {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var due []eventTopic
+	for _, t := range b.topics {
+		watched := false
+		for sub := range b.subs {
+			if sub.topics[t.name] {
+				watched = true
+				break
+			}
+		}
+		if !watched {
+			delete(b.last, t.name)
+			delete(b.sampled, t.name)
+			continue
+		}
+		if time.Since(b.sampled[t.name]) >= t.interval {
+			b.sampled[t.name] = time.Now()
+			due = append(due, t)
+		}
+	}
+	return due
+}
+
+// Publish sends v to the subscribers of topic if it differs from the last
+// value published
+func (b *EventBus) Publish(topic string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		eventsLog.Error("Failed to encode event", "topic", topic, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.last[topic]; ok && bytes.Equal(last.Data, data) {
+		return
+	}
+	b.seq++
+	ev := Event{ID: b.seq, Topic: topic, Data: data}
+	b.last[topic] = ev
+	for sub := range b.subs {
+		if !sub.topics[topic] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// Too slow; drop it rather than block publishing
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Subscribe registers for topics and returns the latest value of each that
+// has one, the subscriber, and a function to unsubscribe
+func (b *EventBus) Subscribe(topics []string) ([]Event, *eventSubscriber, func()) {
+	sub := &eventSubscriber{topics: make(map[string]bool), ch: make(chan Event, 32)}
+	for _, t := range topics {
+		sub.topics[t] = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var snapshot []Event
+	for _, t := range b.topics {
+		if ev, ok := b.last[t.name]; ok && sub.topics[t.name] {
+			snapshot = append(snapshot, ev)
+		}
+	}
+	if b.closed {
+		close(sub.ch)
+	} else {
+		b.subs[sub] = true
+	}
+	return snapshot, sub, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.subs[sub] {
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Close ends all event streams so HTTP shutdown does not wait on them
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Topics returns the names of all topics
+func (b *EventBus) Topics() []string {
+	names := make([]string, 0, len(b.topics))
+	for _, t := range b.topics {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// handleEvents streams topic updates as Server-Sent Events. ?topics= is a
+// comma-separated list; all topics are sent without it. Each event is named
+// after its topic and carries the same JSON as the topic's API endpoint,
+// except that backup leaves out the snapshot list, which means listing the
+// repository.
+func (s *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	topics := s.events.Topics()
+	if q := r.URL.Query().Get("topics"); q != "" {
+		topics = strings.Split(q, ",")
+	}
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	snapshot, sub, unsubscribe := s.events.Subscribe(topics)
+	defer unsubscribe()
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, ev := range snapshot {
+		writeEvent(w, ev)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes ev in text/event-stream format
+func writeEvent(w http.ResponseWriter, ev Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Topic, ev.Data)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Loggers for each part of the daemon; logging.subsystems sets their
+// levels by these names
+var (
+	mainLog      = newLogger("main")
+	httpLog      = newLogger("http")
+	requestLog   = newLogger("request")
+	authLog      = newLogger("auth")
+	backupLog    = newLogger("backup")
+	configLog    = newLogger("config")
+	eventsLog    = newLogger("events")
+	quicLog      = newLogger("quic")
+	removableLog = newLogger("removable")
+	searchLog    = newLogger("search")
+	storageLog   = newLogger("storage")
+	thumbsLog    = newLogger("thumbs")
+	tlsLog       = newLogger("tls")
+	tunnelLog    = newLogger("tunnel")
+)
+
+// logSubsystems lists the subsystem names, in the order newLogger saw them
+var logSubsystems []string
+
+func newLogger(subsystem string) *slog.Logger {
+	logSubsystems = append(logSubsystems, subsystem)
+	return slog.New(&logHandler{subsystem: subsystem})
+}
+
+// fatal logs an error and exits
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// validateLogging checks the logging section of the config
+func validateLogging(c LoggingConfig) error {
+	if _, err := parseLogLevel(c.Level); err != nil {
+		return fmt.Errorf("logging.level: %w", err)
+	}
+	for name, level := range c.Subsystems {
+		if !slices.Contains(logSubsystems, name) {
+			return fmt.Errorf("logging.subsystems: unknown subsystem %q (known: %s)", name, strings.Join(logSubsystems, ", "))
+		}
+		if _, err := parseLogLevel(level); err != nil {
+			return fmt.Errorf("logging.subsystems.%s: %w", name, err)
+		}
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("logging.format must be text or json, not %q", c.Format)
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("logging.buffer_size must not be negative")
+	}
+	return nil
+}
+
+// logSink is where records go: the formatted output, the minimum levels
+// and the buffer for the Logs page. It is replaced as a whole when the
+// levels change.
+type logSink struct {
+	out    slog.Handler
+	level  slog.Level
+	levels map[string]slog.Level
+	ring   *logRing
+}
+
+var currentSink atomic.Pointer[logSink]
+
+func init() {
+	currentSink.Store(&logSink{out: newLogOutput(os.Stderr, "text"), ring: newLogRing(1000)})
+	// Messages from the standard log package, e.g. http.Server errors
+	slog.SetDefault(slog.New(&logHandler{}))
+}
+
+// levelFor returns the minimum level logged for a subsystem
+func (s *logSink) levelFor(subsystem string) slog.Level {
+	if level, ok := s.levels[subsystem]; ok {
+		return level
+	}
+	return s.level
+}
+
+// newLogOutput formats records as text or JSON, with the source file and
+// line but not the full path
+func newLogOutput(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey && len(groups) == 0 {
+				return slog.String(slog.SourceKey, filepath.Base(src.File)+":"+strconv.Itoa(src.Line))
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging applies the logging config at startup
+func setupLogging(c LoggingConfig) {
+	sink := &logSink{out: newLogOutput(os.Stderr, c.Format), ring: newLogRing(c.BufferSize)}
+	sink.level, sink.levels = logLevels(c)
+	currentSink.Store(sink)
+}
+
+// setLogLevels changes the levels while running; format and buffer size
+// need a restart
+func setLogLevels(c LoggingConfig) {
+	sink := *currentSink.Load()
+	sink.level, sink.levels = logLevels(c)
+	currentSink.Store(&sink)
+}
+
+// logLevels parses validated level settings
+func logLevels(c LoggingConfig) (slog.Level, map[string]slog.Level) {
+	level, _ := parseLogLevel(c.Level)
+	levels := make(map[string]slog.Level)
+	for name, s := range c.Subsystems {
+		levels[name], _ = parseLogLevel(s)
+	}
+	return level, levels
+}
+
+// logHandler filters records by the level of its subsystem, adds the
+// request ID from the context and sends them to the current sink
+type logHandler struct {
+	subsystem string
+	// ops are the attributes and groups added with WithAttrs and
+	// WithGroup, in order
+	ops []logOp
+}
+
+type logOp struct {
+	group string
+	attrs []slog.Attr
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= currentSink.Load().levelFor(h.subsystem)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	sink := currentSink.Load()
+	if id := requestIDFrom(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	sink.ring.add(h.entry(r))
+
+	out := sink.out
+	if h.subsystem != "" {
+		out = out.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	}
+	for _, op := range h.ops {
+		if op.group != "" {
+			out = out.WithGroup(op.group)
+		} else {
+			out = out.WithAttrs(op.attrs)
+		}
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{subsystem: h.subsystem, ops: append(slices.Clip(h.ops), logOp{attrs: attrs})}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &logHandler{subsystem: h.subsystem, ops: append(slices.Clip(h.ops), logOp{group: name})}
+}
+
+// entry flattens a record for the log buffer, joining group names to keys
+// with dots
+func (h *logHandler) entry(r slog.Record) LogEntry {
+	e := LogEntry{
+		Time:      r.Time,
+		Level:     r.Level.String(),
+		level:     r.Level,
+		Subsystem: h.subsystem,
+		Message:   r.Message,
+		Attrs:     make(map[string]string),
+	}
+	prefix := ""
+	for _, op := range h.ops {
+		if op.group != "" {
+			prefix += op.group + "."
+		}
+		for _, a := range op.attrs {
+			flattenAttr(e.Attrs, prefix, a)
+		}
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		flattenAttr(e.Attrs, prefix, a)
+		return true
+	})
+	return e
+}
+
+func flattenAttr(attrs map[string]string, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			flattenAttr(attrs, prefix, ga)
+		}
+		return
+	}
+	if a.Key != "" {
+		attrs[prefix+a.Key] = v.String()
+	}
+}
+
+// LogEntry is a log record kept for the Logs page
+type LogEntry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Level     string            `json:"level"`
+	Subsystem string            `json:"subsystem"`
+	Message   string            `json:"message"`
+	Attrs     map[string]string `json:"attrs"`
+
+	level slog.Level
+}
+
+// logRing keeps the most recent log entries
+type logRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	seq     uint64
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{entries: make([]LogEntry, 0, size)}
+}
+
+func (r *logRing) add(e LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cap(r.entries) == 0 {
+		return
+	}
+	r.seq++
+	e.Seq = r.seq
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// LogFilter selects entries from the log buffer. After skips entries up
+// to and including that sequence number, for following new entries.
+type LogFilter struct {
+	Level     slog.Level
+	Subsystem string
+	Search    string
+	After     uint64
+	Limit     int
+}
+
+// Entries returns the newest entries matching f, oldest first
+func (r *logRing) Entries(f LogFilter) []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := []LogEntry{}
+	search := strings.ToLower(f.Search)
+	for i := len(r.entries) - 1; i >= 0 && (f.Limit <= 0 || len(entries) < f.Limit); i-- {
+		e := r.entries[(r.next+i)%len(r.entries)]
+		if e.Seq <= f.After {
+			break
+		}
+		if e.level < f.Level || (f.Subsystem != "" && e.Subsystem != f.Subsystem) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(e.Message), search) && !attrsContain(e.Attrs, search) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	slices.Reverse(entries)
+	return entries
+}
+
+func attrsContain(attrs map[string]string, search string) bool {
+	for _, v := range attrs {
+		if strings.Contains(strings.ToLower(v), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// recentLogs returns entries from the current log buffer
+func recentLogs(f LogFilter) []LogEntry {
+	return currentSink.Load().ring.Entries(f)
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID logRequests gave the request, if any
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logRequests gives each request an ID, returned in X-Request-ID and added
+// to everything logged with the request's context, and logs the request
+// when it finishes
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID()
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelWarn
+		} else if r.URL.Path == "/api/logs" {
+			// The Logs page polls this; don't fill the buffer it shows
+			level = slog.LevelDebug
+		}
+		requestLog.LogAttrs(ctx, level, "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("protocol", requestProtocol(r)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
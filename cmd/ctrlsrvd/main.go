@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"maps"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -17,12 +22,13 @@ const (
 )
 
 var (
-	configPath = flag.String("config", "../../config.yaml", "Path to config file (defaults to config.yaml or config.example.yaml)")
+	configPath = flag.String("config", "", "Path to config file (default: $CONFIG_PATH, "+systemConfigPath+", config.yaml or config.example.yaml)")
 	noGUI      = flag.Bool("no-gui", false, "Run without opening browser (headless mode)")
 	version    = flag.Bool("version", false, "Print version and exit")
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	// Handle version flag
@@ -30,38 +36,77 @@ func main() {
 		fmt.Printf("%s version %s\n", appName, appVersion)
 		os.Exit(0)
 	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 
-	// Setup logging
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	log.Printf("%s %s starting...", appName, appVersion)
+	mainLog.Info("Starting", "app", appName, "version", appVersion)
 
 	// Load configuration
-	cfg, err := loadConfig(*configPath)
+	path, source, err := findConfig(*configPath)
+	if err != nil {
+		fatal(mainLog, "Failed to load config", "error", err)
+	}
+	mainLog.Info("Using config", "path", path, "source", source)
+	cfg, err := loadConfig(path)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal(mainLog, "Failed to load config", "path", path, "error", err)
+	}
+	// The same checks as a reload or a web edit, so the daemon never runs
+	// a config it would refuse to apply
+	if err := cfg.Validate(); err != nil {
+		fatal(mainLog, "Invalid config", "path", path, "error", err)
+	}
+	setupLogging(cfg.Logging)
+	overrides := cfg.Overrides()
+	for _, setting := range slices.Sorted(maps.Keys(overrides)) {
+		mainLog.Info("Config override", "setting", setting, "source", overrides[setting])
 	}
 
-	// Check storage availability
-	if err := checkStorage(cfg.Storage.Path); err != nil {
-		log.Fatalf("Storage check failed: %v", err)
+	// Check storage availability; only mandatory volumes are fatal
+	if err := checkMandatoryVolumes(cfg.Storage.Volumes); err != nil {
+		fatal(mainLog, "Storage check failed", "error", err)
 	}
 
-	// Start API server in background
+	// Start API server and its background workers
 	apiServer := NewAPIServer(cfg)
+	if cfg.Auth.Enabled {
+		if err := apiServer.auth.Bootstrap(); err != nil {
+			fatal(mainLog, "Failed to initialize authentication", "error", err)
+		}
+	} else {
+		mainLog.Warn("Authentication is disabled; anyone who can reach the API has full access")
+	}
+	// Workers get their own context so they keep running while requests
+	// drain during shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	apiServer.RunBackground(workerCtx)
+
+	serverErr := make(chan error, 3)
 	go func() {
-		log.Printf("Starting HTTP API on %s", cfg.Server.ListenAddr)
-		if err := apiServer.Start(); err != nil {
-			log.Fatalf("API server failed: %v", err)
+		mainLog.Info("Starting HTTP API", "addr", cfg.Server.ListenAddr)
+		if err := apiServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- fmt.Errorf("API server failed: %w", err)
 		}
 	}()
 
+	if cfg.Server.MetricsAddr != "" {
+		go func() {
+			if err := apiServer.StartMetrics(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("metrics server failed: %w", err)
+			}
+		}()
+	}
+
 	// Start QUIC server in background
+	var quicServer *QUICServer
 	if cfg.Server.QUICAddr != "" {
-		quicServer := NewQUICServer(cfg)
+		// Share the API handler so both listeners see the same state
+		quicServer = NewQUICServer(cfg, apiServer.Handler(), apiServer.ca)
 		go func() {
-			log.Printf("Starting QUIC server on %s", cfg.Server.QUICAddr)
-			if err := quicServer.Start(); err != nil {
-				log.Fatalf("QUIC server failed: %v", err)
+			mainLog.Info("Starting QUIC server", "addr", cfg.Server.QUICAddr)
+			if err := quicServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("QUIC server failed: %w", err)
 			}
 		}()
 	}
@@ -70,17 +115,78 @@ func main() {
 	if !*noGUI && os.Getenv("DISPLAY") != "" {
 		go openKioskBrowser(cfg.Server.ListenAddr)
 	} else if !*noGUI {
-		log.Println("No DISPLAY found, running in headless mode")
+		mainLog.Info("No DISPLAY found, running in headless mode")
 	} else {
-		log.Println("Running in headless mode (--no-gui)")
+		mainLog.Info("Running in headless mode (--no-gui)")
 	}
 
+	// Reload the reloadable parts of the config on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			mainLog.Info("Received SIGHUP, reloading config")
+			if _, err := apiServer.ReloadConfig(); err != nil {
+				mainLog.Error("Config reload failed, keeping current config", "error", err)
+			}
+		}
+	}()
+
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	exitCode := 0
+	select {
+	case sig := <-sigChan:
+		mainLog.Info("Shutting down", "signal", sig.String())
+	case err := <-serverErr:
+		mainLog.Error("Shutting down after server failure", "error", err)
+		exitCode = 1
+	}
+	go func() {
+		<-sigChan
+		mainLog.Warn("Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	shutdown(cfg, apiServer, quicServer, stopWorkers)
+	os.Exit(exitCode)
+}
 
-	log.Println("Shutting down...")
+// shutdown stops ctrlsrvd in order: the listeners stop accepting and drain
+// in-flight requests, then background workers are cancelled and awaited so
+// their state is saved before exit. Each phase gets shutdown_timeout.
+func shutdown(cfg *Config, apiServer *APIServer, quicServer *QUICServer, stopWorkers context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := apiServer.Shutdown(ctx); err != nil {
+			mainLog.Warn("HTTP requests did not finish in time", "error", err)
+		}
+	}()
+	if quicServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := quicServer.Shutdown(ctx); err != nil {
+				mainLog.Warn("QUIC requests did not finish in time", "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	mainLog.Info("Listeners closed, stopping background jobs")
+
+	stopWorkers()
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := apiServer.Wait(ctx); err != nil {
+		mainLog.Warn("Background jobs did not stop in time", "error", err)
+		return
+	}
+	mainLog.Info("Shutdown complete")
 }
 
 // openKioskBrowser opens a browser in kiosk/fullscreen mode
@@ -93,7 +199,7 @@ func openKioskBrowser(addr string) {
 		url = "http://localhost:8080"
 	}
 
-	log.Printf("Opening kiosk browser for: %s", url)
+	mainLog.Info("Opening kiosk browser", "url", url)
 
 	// Try browsers in order of preference (lightest first)
 	browsers := [][]string{
@@ -104,16 +210,15 @@ func openKioskBrowser(addr string) {
 
 	for _, browser := range browsers {
 		if _, err := exec.LookPath(browser[0]); err == nil {
-			log.Printf("Launching browser: %s", browser[0])
+			mainLog.Info("Launching browser", "browser", browser[0])
 			cmd := exec.Command(browser[0], browser[1:]...)
 			if err := cmd.Start(); err != nil {
-				log.Printf("Failed to start %s: %v", browser[0], err)
+				mainLog.Warn("Failed to start browser", "browser", browser[0], "error", err)
 				continue
 			}
 			return
 		}
 	}
 
-	log.Printf("No suitable browser found. Access UI at: %s", url)
-	log.Println("Install one of: surf, netsurf-gtk, midori")
+	mainLog.Warn("No suitable browser found; install one of surf, netsurf-gtk, midori", "url", url)
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type requestKey struct {
+	route, protocol, code string
+}
+
+type latencyKey struct {
+	route, protocol string
+}
+
+// latencyHistogram counts requests per latency bucket; the last count is
+// for requests slower than every bucket
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Metrics records request counts and latencies for the Prometheus
+// endpoint. Everything else is sampled when it is scraped.
+type Metrics struct {
+	started time.Time
+
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	latency  map[latencyKey]*latencyHistogram
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		started:  time.Now(),
+		requests: make(map[requestKey]uint64),
+		latency:  make(map[latencyKey]*latencyHistogram),
+	}
+}
+
+// Observe records a finished request
+func (m *Metrics) Observe(route, protocol string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, protocol, strconv.Itoa(code)}]++
+
+	key := latencyKey{route, protocol}
+	h := m.latency[key]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[key] = h
+	}
+	secs := d.Seconds()
+	h.counts[sort.SearchFloat64s(latencyBuckets, secs)]++
+	h.count++
+	h.sum += secs
+}
+
+// requestProtocol names the protocol a request arrived over for metrics
+func requestProtocol(r *http.Request) string {
+	switch {
+	case viaTunnel(r):
+		return "tunnel"
+	case r.ProtoMajor == 3:
+		return "h3"
+	case r.ProtoMajor == 2:
+		return "h2"
+	default:
+		return "http/1.1"
+	}
+}
+
+// statusRecorder remembers the status code a handler sent
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps archive downloads streaming through the recorder
+func (w *statusRecorder) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument records the count and latency of requests to route
+func (m *Metrics) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			m.Observe(route, requestProtocol(r), rec.status, time.Since(start))
+		}()
+		h(rec, r)
+	}
+}
+
+// metricWriter writes the Prometheus text exposition format
+type metricWriter struct {
+	w io.Writer
+}
+
+// family starts a metric with its help text and type
+func (mw metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value; labels are name/value pairs
+func (mw metricWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(mw.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+		}
+		fmt.Fprintf(mw.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(mw.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeRequests writes the request counters and latency histograms
+func (m *Metrics) writeRequests(mw metricWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.protocol != b.protocol {
+			return a.protocol < b.protocol
+		}
+		return a.code < b.code
+	})
+	mw.family("ctrlsrv_http_requests_total", "counter", "HTTP requests by route, protocol and status code.")
+	for _, k := range requests {
+		mw.sample("ctrlsrv_http_requests_total", float64(m.requests[k]), "route", k.route, "protocol", k.protocol, "code", k.code)
+	}
+
+	latency := make([]latencyKey, 0, len(m.latency))
+	for k := range m.latency {
+		latency = append(latency, k)
+	}
+	sort.Slice(latency, func(i, j int) bool {
+		if latency[i].route != latency[j].route {
+			return latency[i].route < latency[j].route
+		}
+		return latency[i].protocol < latency[j].protocol
+	})
+	const name = "ctrlsrv_http_request_duration_seconds"
+	mw.family(name, "histogram", "HTTP request latency by route and protocol.")
+	for _, k := range latency {
+		h := m.latency[k]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			mw.sample(name+"_bucket", float64(cumulative), "route", k.route, "protocol", k.protocol, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		mw.sample(name+"_bucket", float64(h.count), "route", k.route, "protocol", k.protocol, "le", "+Inf")
+		mw.sample(name+"_sum", h.sum, "route", k.route, "protocol", k.protocol)
+		mw.sample(name+"_count", float64(h.count), "route", k.route, "protocol", k.protocol)
+	}
+}
+
+// writeRuntime writes Go runtime statistics
+func (m *Metrics) writeRuntime(mw metricWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	mw.family("go_info", "gauge", "Go version the daemon was built with.")
+	mw.sample("go_info", 1, "version", runtime.Version())
+	mw.family("go_goroutines", "gauge", "Number of goroutines.")
+	mw.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	mw.family("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	mw.sample("go_memstats_alloc_bytes", float64(mem.HeapAlloc))
+	mw.family("go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.")
+	mw.sample("go_memstats_heap_inuse_bytes", float64(mem.HeapInuse))
+	mw.family("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	mw.sample("go_memstats_sys_bytes", float64(mem.Sys))
+	mw.family("go_gc_cycles_total", "counter", "Completed GC cycles.")
+	mw.sample("go_gc_cycles_total", float64(mem.NumGC))
+	mw.family("go_gc_pause_seconds_total", "counter", "Total time the world was stopped for GC.")
+	mw.sample("go_gc_pause_seconds_total", float64(mem.PauseTotalNs)/1e9)
+	mw.family("process_start_time_seconds", "gauge", "Start time of the daemon since the Unix epoch.")
+	mw.sample("process_start_time_seconds", float64(m.started.Unix()))
+}
+
+// cupsQueuedJobs counts the jobs waiting in a CUPS queue
+func cupsQueuedJobs(printer string) (int, error) {
+	out, err := exec.Command("lpstat", "-o", printer).Output()
+	if err != nil {
+		return 0, err
+	}
+	jobs := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			jobs++
+		}
+	}
+	return jobs, nil
+}
+
+// countFiles counts the regular files directly in dir with the given
+// extension
+func countFiles(dir, ext string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.EqualFold(filepath.Ext(e.Name()), ext) {
+			n++
+		}
+	}
+	return n
+}
+
+// handleMetrics serves metrics in the Prometheus text format
+func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	cfg := s.config.Load()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricWriter{w}
+
+	mw.family("ctrlsrv_build_info", "gauge", "Version of ctrlsrvd.")
+	mw.sample("ctrlsrv_build_info", 1, "version", appVersion)
+
+	volumes := checkVolumes(cfg.Storage.Volumes)
+	mw.family("ctrlsrv_storage_available", "gauge", "Whether the volume is mounted and writable.")
+	for _, v := range volumes {
+		mw.sample("ctrlsrv_storage_available", boolValue(v.Available), "volume", v.Name, "role", v.Role)
+	}
+	mw.family("ctrlsrv_storage_used_bytes", "gauge", "Used space on the volume.")
+	for _, v := range volumes {
+		if v.Available {
+			mw.sample("ctrlsrv_storage_used_bytes", float64(v.Used), "volume", v.Name, "role", v.Role)
+		}
+	}
+	mw.family("ctrlsrv_storage_free_bytes", "gauge", "Free space on the volume.")
+	for _, v := range volumes {
+		if v.Available {
+			mw.sample("ctrlsrv_storage_free_bytes", float64(v.Free), "volume", v.Name, "role", v.Role)
+		}
+	}
+	mw.family("ctrlsrv_storage_total_bytes", "gauge", "Size of the volume.")
+	for _, v := range volumes {
+		if v.Available {
+			mw.sample("ctrlsrv_storage_total_bytes", float64(v.Total), "volume", v.Name, "role", v.Role)
+		}
+	}
+
+	services := servicesStatus().Services
+	mw.family("ctrlsrv_service_active", "gauge", "Whether the systemd service is active.")
+	for _, svc := range services {
+		mw.sample("ctrlsrv_service_active", boolValue(svc.Active), "service", svc.Name)
+	}
+	mw.family("ctrlsrv_service_enabled", "gauge", "Whether the systemd service starts on boot.")
+	for _, svc := range services {
+		mw.sample("ctrlsrv_service_enabled", boolValue(svc.Enabled), "service", svc.Name)
+	}
+
+	mw.family("ctrlsrv_print_queue_jobs", "gauge", "Jobs waiting in the CUPS queue.")
+	if cfg.CUPS.Printer != "" {
+		if jobs, err := cupsQueuedJobs(cfg.CUPS.Printer); err == nil {
+			mw.sample("ctrlsrv_print_queue_jobs", float64(jobs), "printer", cfg.CUPS.Printer)
+		}
+	}
+	// The print watcher moves files it handled into processed/ or errors/
+	drop := cfg.GetPrintDropPath()
+	mw.family("ctrlsrv_print_jobs", "gauge", "Files handled by the print watcher, by outcome.")
+	mw.sample("ctrlsrv_print_jobs", float64(countFiles(filepath.Join(drop, "processed"), ".pdf")), "outcome", "submitted")
+	mw.sample("ctrlsrv_print_jobs", float64(countFiles(filepath.Join(drop, "errors"), ".pdf")), "outcome", "failed")
+	mw.family("ctrlsrv_printdrop_queue_files", "gauge", "PDFs in the print drop folder waiting to be printed.")
+	mw.sample("ctrlsrv_printdrop_queue_files", float64(countFiles(drop, ".pdf")))
+
+	s.metrics.writeRequests(mw)
+	s.metrics.writeRuntime(mw)
+}
+
+// metricsHandler serves /metrics for the metrics listener. Network access
+// control and, with auth enabled, a viewer token apply as on the API.
+func (s *APIServer) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.requireRole(policyViewer, s.handleMetrics))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.access.Load().Middleware(mux).ServeHTTP(w, r)
+	})
+}
+
+// StartMetrics serves metrics on server.metrics_addr. It returns
+// http.ErrServerClosed after Shutdown.
+func (s *APIServer) StartMetrics() error {
+	httpLog.Info("Metrics listening", "addr", s.metricsServer.Addr)
+	return s.metricsServer.ListenAndServe()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// loadClientCAs reads the PEM bundle of CAs trusted to sign client certificates
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// configureClientAuth makes tlsConfig require client certificates signed
+// by the configured CA or the internal one, if ca is not nil. Certificates
+// the internal CA has revoked are refused during the handshake.
+func configureClientAuth(cfg *Config, tlsConfig *tls.Config, ca *CertAuthority) error {
+	if !cfg.MTLS.Enabled {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if cfg.MTLS.CAFile != "" {
+		var err error
+		if pool, err = loadClientCAs(cfg.MTLS.CAFile); err != nil {
+			return err
+		}
+	} else if ca == nil {
+		return fmt.Errorf("no client CA configured")
+	}
+	if ca != nil {
+		pool.AddCert(ca.Root())
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if ca.Revoked(cs.VerifiedChains) {
+				return fmt.Errorf("client certificate %q has been revoked", cs.PeerCertificates[0].Subject.CommonName)
+			}
+			return nil
+		}
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// certIdentities returns the names a client certificate can be matched by:
+// its common name followed by its DNS, email and URI SANs
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
+
+// certificatePrincipal maps a verified client certificate to a principal.
+// Identities configured without a role (such as the edge proxy, which
+// relays other users' requests) only open the connection and grant nothing.
+// Certificates from the internal CA carry the role they were issued with,
+// and stop working as soon as they are revoked, even on open connections.
+func (s *APIServer) certificatePrincipal(r *http.Request) (Principal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Principal{}, false
+	}
+	if s.ca != nil && s.ca.Revoked(r.TLS.VerifiedChains) {
+		return Principal{}, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	cfg := s.config.Load()
+
+	for _, id := range certIdentities(cert) {
+		for _, m := range cfg.MTLS.Identities {
+			if m.Match != id {
+				continue
+			}
+			if m.Role == "" {
+				return Principal{}, false
+			}
+			name := m.Username
+			if name == "" {
+				name = id
+			}
+			return Principal{Username: name, Role: Role(m.Role), Method: "certificate"}, true
+		}
+	}
+
+	if s.ca != nil {
+		if issued, ok := s.ca.Lookup(r.TLS.VerifiedChains[0]); ok && issued.Role != "" {
+			return Principal{Username: issued.Name, Role: issued.Role, Method: "certificate"}, true
+		}
+	}
+
+	if cfg.MTLS.DefaultRole == "" {
+		return Principal{}, false
+	}
+	return Principal{Username: cert.Subject.CommonName, Role: Role(cfg.MTLS.DefaultRole), Method: "certificate"}, true
+}
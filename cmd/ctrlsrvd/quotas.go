@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errQuotaExceeded is returned when a write would exceed a hard quota
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaUsage reports the usage of one quota-controlled share
+type QuotaUsage struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Used     uint64    `json:"used_bytes"`
+	Files    int       `json:"files"`
+	Soft     int64     `json:"soft_bytes,omitempty"`
+	Hard     int64     `json:"hard_bytes,omitempty"`
+	UsedPct  float64   `json:"used_percent"`
+	OverSoft bool      `json:"over_soft"`
+	OverHard bool      `json:"over_hard"`
+	Scanned  time.Time `json:"scanned,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// QuotaManager accounts disk usage per Samba share or top-level directory
+// and enforces the configured limits on writes made through the API.
+// Usage is recomputed by a periodic walk; API writes are added as they
+// happen so back-to-back uploads cannot slip past a hard limit.
+type QuotaManager struct {
+	config *Config
+
+	mu    sync.Mutex
+	usage map[string]*QuotaUsage
+}
+
+// NewQuotaManager creates a new quota manager
+func NewQuotaManager(cfg *Config) *QuotaManager {
+	q := &QuotaManager{
+		config: cfg,
+		usage:  make(map[string]*QuotaUsage),
+	}
+	for _, qc := range cfg.Quotas.Shares {
+		q.usage[qc.Name] = &QuotaUsage{Name: qc.Name, Path: qc.Path, Soft: qc.Soft, Hard: qc.Hard}
+	}
+	return q
+}
+
+// Run recomputes usage every interval until ctx is cancelled
+func (q *QuotaManager) Run(ctx context.Context) {
+	if len(q.config.Quotas.Shares) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(q.config.Quotas.Interval)
+	defer ticker.Stop()
+	for {
+		q.Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh walks every quota share and updates its usage
+func (q *QuotaManager) Refresh(ctx context.Context) {
+	for _, qc := range q.config.Quotas.Shares {
+		used, files, err := q.measure(ctx, qc.Path)
+		if ctx.Err() != nil {
+			return
+		}
+
+		q.mu.Lock()
+		u := q.usage[qc.Name]
+		wasOver := u.OverSoft
+		u.Scanned = time.Now()
+		u.Error = ""
+		if err != nil {
+			u.Error = err.Error()
+		} else {
+			u.Used, u.Files = used, files
+		}
+		q.updateLocked(u)
+		nowOver := u.OverSoft
+		q.mu.Unlock()
+
+		if nowOver && !wasOver {
+			storageLog.Warn("Share is over its soft quota", "share", qc.Name, "used", formatBytes(used), "soft", formatBytes(uint64(qc.Soft)))
+		}
+	}
+}
+
+// measure sums the apparent size of all files below rel, counting
+// hardlinked files once
+func (q *QuotaManager) measure(ctx context.Context, rel string) (uint64, int, error) {
+	root, err := resolveStoragePath(q.config.Storage.Path, rel)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var used uint64
+	files := 0
+	inodes := make(map[[2]uint64]bool)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".ctrlsrv") {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if key, ok := fileID(info); ok {
+			if inodes[key] {
+				return nil
+			}
+			inodes[key] = true
+		}
+		used += uint64(info.Size())
+		files++
+		return nil
+	})
+	return used, files, err
+}
+
+// updateLocked recomputes the derived fields of u. Caller holds q.mu.
+func (q *QuotaManager) updateLocked(u *QuotaUsage) {
+	limit := u.Hard
+	if limit == 0 {
+		limit = u.Soft
+	}
+	u.UsedPct = 0
+	if limit > 0 {
+		u.UsedPct = float64(u.Used) / float64(limit) * 100
+	}
+	u.OverSoft = u.Soft > 0 && u.Used >= uint64(u.Soft)
+	u.OverHard = u.Hard > 0 && u.Used >= uint64(u.Hard)
+}
+
+// Usage returns the usage of all quota shares in config order
+func (q *QuotaManager) Usage() []QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]QuotaUsage, 0, len(q.config.Quotas.Shares))
+	for _, qc := range q.config.Quotas.Shares {
+		list = append(list, *q.usage[qc.Name])
+	}
+	return list
+}
+
+// sharesFor returns the quota shares containing rel. Caller holds q.mu.
+func (q *QuotaManager) sharesFor(rel string) []*QuotaUsage {
+	rel = cleanStorageRel(rel)
+	var list []*QuotaUsage
+	for _, qc := range q.config.Quotas.Shares {
+		p := cleanStorageRel(qc.Path)
+		if p == "" || rel == p || strings.HasPrefix(rel, p+"/") {
+			list = append(list, q.usage[qc.Name])
+		}
+	}
+	return list
+}
+
+// Check returns errQuotaExceeded if writing size more bytes to rel would
+// exceed the hard limit of a share containing it
+func (q *QuotaManager) Check(rel string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.checkLocked(rel, size)
+}
+
+// Reserve is Check that also records size bytes as used if they fit, in
+// one step, so concurrent writers cannot together overshoot the limit.
+// Give the space back with Add(rel, -size) if the write is abandoned.
+func (q *QuotaManager) Reserve(rel string, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkLocked(rel, size); err != nil {
+		return err
+	}
+	q.addLocked(rel, size)
+	return nil
+}
+
+// checkLocked is Check without locking. Caller holds q.mu.
+func (q *QuotaManager) checkLocked(rel string, size int64) error {
+	for _, u := range q.sharesFor(rel) {
+		if u.Hard > 0 && u.Used+uint64(max(size, 0)) > uint64(u.Hard) {
+			return fmt.Errorf("%w: share %s has %s of %s used", errQuotaExceeded, u.Name, formatBytes(u.Used), formatBytes(uint64(u.Hard)))
+		}
+	}
+	return nil
+}
+
+// Remaining returns how many bytes may still be written to rel, or -1 if
+// no hard limit applies
+func (q *QuotaManager) Remaining(rel string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	remaining := int64(-1)
+	for _, u := range q.sharesFor(rel) {
+		if u.Hard == 0 {
+			continue
+		}
+		left := max(u.Hard-int64(u.Used), 0)
+		if remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining
+}
+
+// Add records size bytes written to rel ahead of the next refresh
+func (q *QuotaManager) Add(rel string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.addLocked(rel, size)
+}
+
+// addLocked is Add without locking. Caller holds q.mu.
+func (q *QuotaManager) addLocked(rel string, size int64) {
+	for _, u := range q.sharesFor(rel) {
+		u.Used = uint64(max(int64(u.Used)+size, 0))
+		q.updateLocked(u)
+	}
+}
+
+// Alerts returns health alerts for shares over their soft or hard limit
+func (q *QuotaManager) Alerts() []string {
+	var alerts []string
+	for _, u := range q.Usage() {
+		switch {
+		case u.OverHard:
+			alerts = append(alerts, fmt.Sprintf("Share %s is full (%s of %s)", u.Name, formatBytes(u.Used), formatBytes(uint64(u.Hard))))
+		case u.OverSoft:
+			alerts = append(alerts, fmt.Sprintf("Share %s is over its quota (%s of %s)", u.Name, formatBytes(u.Used), formatBytes(uint64(u.Soft))))
+		}
+	}
+	return alerts
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ReloadResult reports the settings a configuration reload changed
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// applyReloadable returns a copy of cur with the settings that can change
+// while running taken from next. Everything else keeps its running value
+// until the daemon is restarted.
+func applyReloadable(cur, next *Config) *Config {
+	cfg := *cur
+	cfg.CUPS = next.CUPS
+	cfg.WireGuard.AllowedNetworks = next.WireGuard.AllowedNetworks
+	cfg.Access = next.Access
+	cfg.Auth.SessionTTL = next.Auth.SessionTTL
+	cfg.Auth.LocalRole = next.Auth.LocalRole
+	cfg.MTLS.DefaultRole = next.MTLS.DefaultRole
+	cfg.MTLS.Identities = next.MTLS.Identities
+	cfg.Shares = next.Shares
+	cfg.Shares.KeyFile = cur.Shares.KeyFile
+	cfg.Search.Enabled = next.Search.Enabled
+	cfg.Search.RescanInterval = next.Search.RescanInterval
+	cfg.Logging.Level = next.Logging.Level
+	cfg.Logging.Subsystems = next.Logging.Subsystems
+	return &cfg
+}
+
+// ConfigChange is a setting that differs between two configurations,
+// named by its YAML path, e.g. "cups.printer"
+type ConfigChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+// configChanges lists the settings that differ between a and b
+func configChanges(a, b *Config) []ConfigChange {
+	changes := []ConfigChange{}
+	diffStruct(reflect.ValueOf(*a), reflect.ValueOf(*b), "", &changes)
+	return changes
+}
+
+// configDiff lists the paths of the settings that differ between a and b
+func configDiff(a, b *Config) []string {
+	paths := []string{}
+	for _, c := range configChanges(a, b) {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+func diffStruct(a, b reflect.Value, prefix string, changes *[]ConfigChange) {
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		av, bv := a.Field(i).Interface(), b.Field(i).Interface()
+		if a.Field(i).Kind() == reflect.Struct {
+			diffStruct(a.Field(i), b.Field(i), name, changes)
+		} else if !reflect.DeepEqual(av, bv) {
+			*changes = append(*changes, ConfigChange{Path: name, Old: displayValue(av), New: displayValue(bv)})
+		}
+	}
+}
+
+// displayValue shows durations the way they are written in the config file
+func displayValue(v any) any {
+	if d, ok := v.(time.Duration); ok {
+		return d.String()
+	}
+	return v
+}
+
+// ReloadConfig re-reads the config file and applies the settings that can
+// change while running. The new file is validated first; if it is invalid
+// nothing changes. Settings that only take effect after a restart are
+// returned in RestartRequired.
+func (s *APIServer) ReloadConfig() (ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload()
+}
+
+// reload implements ReloadConfig. Caller holds s.reloadMu.
+func (s *APIServer) reload() (ReloadResult, error) {
+	cur := s.config.Load()
+	next, err := loadConfig(cur.path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if err := next.Validate(); err != nil {
+		return ReloadResult{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	cfg := applyReloadable(cur, next)
+	access, err := NewAccessControl(cfg)
+	if err != nil {
+		return ReloadResult{}, fmt.Errorf("invalid config: %w", err)
+	}
+	result := ReloadResult{
+		Applied:         configDiff(cur, cfg),
+		RestartRequired: configDiff(cfg, next),
+	}
+
+	// Settings still waiting for a restart keep their old source
+	pending := make(map[string]bool)
+	for _, path := range result.RestartRequired {
+		pending[path] = true
+	}
+	cfg.sources = make(map[string]string)
+	for path, src := range next.sources {
+		if !pending[path] {
+			cfg.sources[path] = src
+		}
+	}
+	for path, src := range cur.sources {
+		if pending[path] {
+			cfg.sources[path] = src
+		}
+	}
+
+	s.access.Store(access)
+	s.auth.SetConfig(cfg)
+	s.shares.SetConfig(cfg)
+	s.search.SetConfig(cfg)
+	s.config.Store(cfg)
+	setLogLevels(cfg.Logging)
+
+	if len(result.Applied) == 0 {
+		configLog.Info("Reloaded config, no changes applied", "path", cur.path)
+	} else {
+		configLog.Info("Reloaded config", "path", cur.path, "applied", strings.Join(result.Applied, ", "))
+	}
+	if len(result.RestartRequired) > 0 {
+		configLog.Warn("Restart required for config changes", "settings", strings.Join(result.RestartRequired, ", "))
+	}
+	return result, nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemovableDevice is a partition on a removable or USB-attached disk
+type RemovableDevice struct {
+	Name       string `json:"name"`
+	Disk       string `json:"disk"`
+	Path       string `json:"path"`
+	Label      string `json:"label"`
+	FSType     string `json:"fstype"`
+	Vendor     string `json:"vendor"`
+	Model      string `json:"model"`
+	Size       uint64 `json:"size_bytes"`
+	MountPoint string `json:"mountpoint,omitempty"`
+	Protected  bool   `json:"protected"`
+}
+
+// ImportStatus reports progress of a copy-to-storage job
+type ImportStatus struct {
+	Running     bool      `json:"running"`
+	Device      string    `json:"device,omitempty"`
+	Dest        string    `json:"dest,omitempty"`
+	Started     time.Time `json:"started,omitempty"`
+	Finished    time.Time `json:"finished,omitempty"`
+	TotalFiles  int       `json:"total_files"`
+	CopiedFiles int       `json:"copied_files"`
+	Skipped     int       `json:"skipped_files"`
+	TotalBytes  uint64    `json:"total_bytes"`
+	CopiedBytes uint64    `json:"copied_bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// RemovableManager detects removable drives and mounts, ejects and imports
+// from them. It refuses to touch any disk holding a configured volume.
+//
+// Platform-specific helpers are defined in removable_linux.go:
+// - scanBlockDevices(protectedPaths []string) ([]RemovableDevice, error)
+// - mountDevice(dev, target string) error
+// - unmountDevice(target string) error
+// - ejectDisk(disk string) error
+// - watchUevents(ctx context.Context, notify func()) error
+type RemovableManager struct {
+	config *Config
+
+	mu      sync.Mutex
+	devices []RemovableDevice
+	imp     ImportStatus
+	cancel  context.CancelFunc
+	rescan  chan struct{}
+	running sync.WaitGroup
+}
+
+// unsafeLabelChars matches characters not allowed in mountpoint names
+var unsafeLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// NewRemovableManager creates a new removable media manager
+func NewRemovableManager(cfg *Config) *RemovableManager {
+	return &RemovableManager{
+		config:  cfg,
+		devices: []RemovableDevice{},
+		rescan:  make(chan struct{}, 1),
+	}
+}
+
+// Run keeps the device list up to date until ctx is cancelled
+func (m *RemovableManager) Run(ctx context.Context) {
+	if !m.config.Removable.Enabled {
+		return
+	}
+
+	go func() {
+		if err := watchUevents(ctx, m.requestRescan); err != nil {
+			removableLog.Warn("Uevent watcher unavailable, polling for removable media", "error", err)
+		}
+	}()
+
+	// Poll as a fallback; uevents trigger an immediate rescan
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		m.scan()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.rescan:
+			// Let the kernel finish creating partitions before probing
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (m *RemovableManager) requestRescan() {
+	select {
+	case m.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// protectedPaths returns the root filesystem and all configured volumes
+func (m *RemovableManager) protectedPaths() []string {
+	paths := []string{"/"}
+	for _, v := range m.config.Storage.Volumes {
+		paths = append(paths, v.Path)
+	}
+	return paths
+}
+
+func (m *RemovableManager) scan() {
+	devices, err := scanBlockDevices(m.protectedPaths())
+	if err != nil {
+		removableLog.Error("Failed to scan block devices", "error", err)
+		return
+	}
+
+	m.mu.Lock()
+	known := make(map[string]bool)
+	for _, d := range m.devices {
+		known[d.Name] = true
+	}
+	for _, d := range devices {
+		if !known[d.Name] && !d.Protected {
+			removableLog.Info("Removable device detected", "device", d.Path, "vendor", d.Vendor, "model", d.Model, "label", d.Label)
+		}
+	}
+	m.devices = devices
+	m.mu.Unlock()
+}
+
+// Devices returns the current list of removable devices
+func (m *RemovableManager) Devices() []RemovableDevice {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RemovableDevice{}, m.devices...)
+}
+
+// ImportStatus returns the progress of the current or last import
+func (m *RemovableManager) ImportStatus() ImportStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.imp
+}
+
+// device looks up a device by name and refuses protected ones
+func (m *RemovableManager) device(name string) (RemovableDevice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.devices {
+		if d.Name == name {
+			if d.Protected {
+				return d, fmt.Errorf("refusing to touch %s: it holds system or storage data", d.Path)
+			}
+			return d, nil
+		}
+	}
+	return RemovableDevice{}, fmt.Errorf("unknown device: %s", name)
+}
+
+// Mount mounts a device below the configured mount root
+func (m *RemovableManager) Mount(name string) (string, error) {
+	dev, err := m.device(name)
+	if err != nil {
+		return "", err
+	}
+	if dev.MountPoint != "" {
+		return dev.MountPoint, nil
+	}
+	if dev.FSType == "" {
+		return "", fmt.Errorf("no recognised filesystem on %s", dev.Path)
+	}
+
+	dirName := unsafeLabelChars.ReplaceAllString(dev.Label, "_")
+	if dirName == "" || strings.Trim(dirName, ".") == "" {
+		dirName = dev.Name
+	}
+	target := filepath.Join(m.config.Removable.MountRoot, dirName)
+	if _, err := os.Stat(target); err == nil {
+		target = filepath.Join(m.config.Removable.MountRoot, dirName+"-"+dev.Name)
+	}
+
+	if err := mountDevice(dev.Path, target); err != nil {
+		return "", err
+	}
+	removableLog.Info("Mounted device", "device", dev.Path, "target", target)
+	m.scan()
+	return target, nil
+}
+
+// Unmount unmounts a device and optionally ejects its disk
+func (m *RemovableManager) Unmount(name string, eject bool) error {
+	dev, err := m.device(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	busy := m.imp.Running && m.imp.Device == name
+	m.mu.Unlock()
+	if busy {
+		return fmt.Errorf("import from %s in progress", dev.Path)
+	}
+
+	if dev.MountPoint != "" {
+		if err := unmountDevice(dev.MountPoint); err != nil {
+			return err
+		}
+		removableLog.Info("Unmounted device", "device", dev.Path)
+	}
+
+	if eject {
+		// Every partition of the disk must be unmounted first
+		for _, other := range m.Devices() {
+			if other.Disk == dev.Disk && other.Name != dev.Name && other.MountPoint != "" {
+				if err := unmountDevice(other.MountPoint); err != nil {
+					return err
+				}
+			}
+		}
+		if err := ejectDisk(dev.Disk); err != nil {
+			return err
+		}
+		removableLog.Info("Ejected disk", "disk", "/dev/"+dev.Disk)
+	}
+
+	m.scan()
+	return nil
+}
+
+// StartImport copies files from a mounted device into a dated folder on
+// storage in the background until done or ctx is cancelled. If photosOnly
+// is set, only files with a configured photo/video extension are copied.
+func (m *RemovableManager) StartImport(ctx context.Context, name string, photosOnly bool) (string, error) {
+	dev, err := m.device(name)
+	if err != nil {
+		return "", err
+	}
+	if dev.MountPoint == "" {
+		return "", fmt.Errorf("%s is not mounted", dev.Path)
+	}
+
+	label := unsafeLabelChars.ReplaceAllString(dev.Label, "_")
+	if label == "" {
+		label = dev.Name
+	}
+	rel := filepath.Join(m.config.Removable.ImportDir, time.Now().Format("2006-01-02"), label)
+	dest, err := resolveStoragePath(m.config.Storage.Path, rel)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	if m.imp.Running {
+		m.mu.Unlock()
+		return "", fmt.Errorf("an import is already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.imp = ImportStatus{Running: true, Device: name, Dest: rel, Started: time.Now()}
+	m.mu.Unlock()
+
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		defer cancel()
+		err := m.importFiles(ctx, dev.MountPoint, dest, photosOnly)
+
+		m.mu.Lock()
+		m.imp.Running = false
+		m.imp.Finished = time.Now()
+		if err != nil {
+			m.imp.Error = err.Error()
+		}
+		status := m.imp
+		m.mu.Unlock()
+
+		if err != nil {
+			removableLog.Error("Import failed", "device", dev.Path, "error", err)
+			return
+		}
+		removableLog.Info("Import complete", "files", status.CopiedFiles, "size", formatBytes(status.CopiedBytes), "device", dev.Path, "dest", dest)
+	}()
+
+	return rel, nil
+}
+
+// Wait blocks until a running import has returned
+func (m *RemovableManager) Wait() {
+	m.running.Wait()
+}
+
+// CancelImport stops a running import
+func (m *RemovableManager) CancelImport() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+func (m *RemovableManager) wantFile(name string, photosOnly bool) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	if !photosOnly {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range m.config.Removable.PhotoExtensions {
+		if ext == strings.ToLower(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RemovableManager) importFiles(ctx context.Context, src, dest string, photosOnly bool) error {
+	// First pass: size up the job so progress can be reported
+	type item struct {
+		path string
+		size int64
+	}
+	var items []item
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != src && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !m.wantFile(d.Name(), photosOnly) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		items = append(items, item{path, info.Size()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var total uint64
+	for _, it := range items {
+		total += uint64(it.size)
+	}
+	if _, free, _, err := getStorageUsage(m.config.Storage.Path); err == nil && free < total {
+		return fmt.Errorf("not enough free space: need %s, have %s", formatBytes(total), formatBytes(free))
+	}
+
+	m.mu.Lock()
+	m.imp.TotalFiles = len(items)
+	m.imp.TotalBytes = total
+	m.mu.Unlock()
+
+	for _, it := range items {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(src, it.path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		// Skip files already imported (same name and size)
+		if info, err := os.Stat(target); err == nil && info.Size() == it.size {
+			m.mu.Lock()
+			m.imp.Skipped++
+			m.imp.CopiedBytes += uint64(it.size)
+			m.mu.Unlock()
+			continue
+		}
+
+		if err := m.copyFile(ctx, it.path, target); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", rel, err)
+		}
+		m.mu.Lock()
+		m.imp.CopiedFiles++
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// copyFile copies src to dst, preserving mtime and reporting progress
+func (m *RemovableManager) copyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".ctrlsrv-import"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		if ctx.Err() != nil {
+			out.Close()
+			os.Remove(tmp)
+			return ctx.Err()
+		}
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				out.Close()
+				os.Remove(tmp)
+				return err
+			}
+			m.mu.Lock()
+			m.imp.CopiedBytes += uint64(n)
+			m.mu.Unlock()
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			out.Close()
+			os.Remove(tmp)
+			return readErr
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,286 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// scanBlockDevices lists partitions (or whole disks without a partition
+// table) of removable and USB-attached block devices. Disks holding any of
+// protectedPaths are flagged as protected (Linux)
+func scanBlockDevices(protectedPaths []string) ([]RemovableDevice, error) {
+	disks, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := readMounts()
+	protected := protectedDisks(protectedPaths)
+
+	devices := []RemovableDevice{}
+	for _, disk := range disks {
+		name := disk.Name()
+		sysPath := filepath.Join("/sys/block", name)
+		if !isRemovableDisk(sysPath) {
+			continue
+		}
+
+		vendor := readSysString(filepath.Join(sysPath, "device", "vendor"))
+		model := readSysString(filepath.Join(sysPath, "device", "model"))
+
+		// Prefer partitions; fall back to the whole disk (superfloppy)
+		var parts []string
+		entries, _ := os.ReadDir(sysPath)
+		for _, e := range entries {
+			if _, err := os.Stat(filepath.Join(sysPath, e.Name(), "partition")); err == nil {
+				parts = append(parts, e.Name())
+			}
+		}
+		if len(parts) == 0 {
+			if readSysUint(filepath.Join(sysPath, "size")) == 0 {
+				continue // empty card reader slot
+			}
+			parts = []string{""}
+		}
+
+		for _, part := range parts {
+			devName, partPath := name, sysPath
+			if part != "" {
+				devName, partPath = part, filepath.Join(sysPath, part)
+			}
+			dev := RemovableDevice{
+				Name:      devName,
+				Disk:      name,
+				Path:      "/dev/" + devName,
+				Vendor:    vendor,
+				Model:     model,
+				Size:      readSysUint(filepath.Join(partPath, "size")) * 512,
+				Protected: protected[name],
+			}
+			dev.Label, dev.FSType = probeFilesystem(dev.Path)
+			dev.MountPoint = mounts[dev.Path]
+			devices = append(devices, dev)
+		}
+	}
+	return devices, nil
+}
+
+// isRemovableDisk reports whether a /sys/block entry is removable or on USB
+func isRemovableDisk(sysPath string) bool {
+	name := filepath.Base(sysPath)
+	for _, prefix := range []string{"loop", "ram", "zram", "dm-", "md", "sr"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if readSysString(filepath.Join(sysPath, "removable")) == "1" {
+		return true
+	}
+	real, err := filepath.EvalSymlinks(sysPath)
+	return err == nil && strings.Contains(real, "/usb")
+}
+
+// protectedDisks returns the names of the disks the given paths live on.
+// The device /etc/fstab mounts at each path counts as well as the one
+// mounted there now, so a storage disk stays protected while unmounted.
+func protectedDisks(paths []string) map[string]bool {
+	protected := make(map[string]bool)
+	sources := readFstab()
+	for _, path := range paths {
+		if src, ok := sources[filepath.Clean(path)]; ok {
+			if real, err := filepath.EvalSymlinks(src); err == nil {
+				if disk := diskOf(filepath.Join("/sys/class/block", filepath.Base(real))); disk != "" {
+					protected[disk] = true
+				}
+			}
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		dev := info.Sys().(*syscall.Stat_t).Dev
+		major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+		minor := dev&0xff | (dev>>12)&^0xff
+		if disk := diskOf(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)); disk != "" {
+			protected[disk] = true
+		}
+	}
+	return protected
+}
+
+// diskOf returns the name of the disk a /sys block device link belongs to
+func diskOf(sysLink string) string {
+	real, err := filepath.EvalSymlinks(sysLink)
+	if err != nil {
+		return ""
+	}
+	// Partitions live inside their parent disk's directory
+	if _, err := os.Stat(filepath.Join(real, "partition")); err == nil {
+		real = filepath.Dir(real)
+	}
+	return filepath.Base(real)
+}
+
+// readFstab maps mountpoints to device paths from /etc/fstab, turning
+// UUID=, LABEL=, PARTUUID= and PARTLABEL= sources into /dev/disk links
+func readFstab() map[string]string {
+	sources := make(map[string]string)
+	f, err := os.Open("/etc/fstab")
+	if err != nil {
+		return sources
+	}
+	defer f.Close()
+
+	links := map[string]string{"UUID": "by-uuid", "LABEL": "by-label", "PARTUUID": "by-partuuid", "PARTLABEL": "by-partlabel"}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		src := strings.ReplaceAll(fields[0], `\040`, " ")
+		if key, value, ok := strings.Cut(src, "="); ok && links[key] != "" {
+			src = filepath.Join("/dev/disk", links[key], value)
+		}
+		if !strings.HasPrefix(src, "/dev/") {
+			continue
+		}
+		sources[filepath.Clean(strings.ReplaceAll(fields[1], `\040`, " "))] = src
+	}
+	return sources
+}
+
+// readMounts maps device paths to mountpoints from /proc/self/mounts
+func readMounts() map[string]string {
+	mounts := make(map[string]string)
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return mounts
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		dev := fields[0]
+		if real, err := filepath.EvalSymlinks(dev); err == nil {
+			dev = real
+		}
+		// Mountpoints escape spaces as \040
+		mounts[dev] = strings.ReplaceAll(fields[1], `\040`, " ")
+	}
+	return mounts
+}
+
+// probeFilesystem returns the label and filesystem type of a device
+func probeFilesystem(dev string) (label, fstype string) {
+	out, err := exec.Command("blkid", "-o", "export", dev).Output()
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v, ok := strings.CutPrefix(line, "LABEL="); ok {
+			label = v
+		} else if v, ok := strings.CutPrefix(line, "TYPE="); ok {
+			fstype = v
+		}
+	}
+	return label, fstype
+}
+
+func readSysString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func readSysUint(path string) uint64 {
+	n, _ := strconv.ParseUint(readSysString(path), 10, 64)
+	return n
+}
+
+// mountDevice mounts a removable device without exec/suid/dev permissions
+func mountDevice(dev, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	out, err := exec.Command("mount", "-o", "nosuid,nodev,noexec", dev, target).CombinedOutput()
+	if err != nil {
+		os.Remove(target)
+		return fmt.Errorf("mount failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmountDevice unmounts a device and removes its mountpoint directory
+func unmountDevice(target string) error {
+	out, err := exec.Command("umount", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unmount failed: %s", strings.TrimSpace(string(out)))
+	}
+	os.Remove(target)
+	return nil
+}
+
+// ejectDisk flushes and powers off a whole disk so it can be unplugged
+func ejectDisk(disk string) error {
+	out, err := exec.Command("eject", "/dev/"+disk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("eject failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// watchUevents calls notify whenever the kernel reports a block device
+// change. It returns when ctx is cancelled or the socket fails.
+func watchUevents(ctx context.Context, notify func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("uevent socket: %w", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1, Pid: 0}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("uevent bind: %w", err)
+	}
+
+	// Unblock the read loop on shutdown
+	go func() {
+		<-ctx.Done()
+		syscall.Shutdown(fd, syscall.SHUT_RDWR)
+		syscall.Close(fd)
+	}()
+
+	buf := make([]byte, 16<<10)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return fmt.Errorf("uevent read: %w", err)
+		}
+		if bytes.Contains(buf[:n], []byte("SUBSYSTEM=block")) {
+			notify()
+		}
+	}
+}
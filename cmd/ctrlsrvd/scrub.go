@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scrubber maintains a checksum manifest of files on the storage volume and
+// incrementally re-verifies them to detect silent corruption (bit rot).
+//
+// A file whose size or mtime changed is assumed to have been edited and is
+// simply re-hashed. A file whose content hash changed while size and mtime
+// stayed the same is reported as a mismatch.
+type Scrubber struct {
+	config *Config
+
+	mu     sync.Mutex
+	status ScrubStatus
+}
+
+// ScrubStatus is the current state of the scrubber
+type ScrubStatus struct {
+	Enabled      bool            `json:"enabled"`
+	Running      bool            `json:"running"`
+	LastRun      time.Time       `json:"last_run,omitempty"`
+	LastDuration string          `json:"last_duration,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	NextRun      time.Time       `json:"next_run,omitempty"`
+	Files        int             `json:"files"`
+	Hashed       int             `json:"hashed"`
+	Verified     int             `json:"verified"`
+	BytesRead    uint64          `json:"bytes_read"`
+	Mismatches   []ScrubMismatch `json:"mismatches"`
+}
+
+// ScrubMismatch describes a file whose content changed without an mtime change
+type ScrubMismatch struct {
+	Path     string    `json:"path"`
+	Expected string    `json:"expected_sha256"`
+	Actual   string    `json:"actual_sha256"`
+	ModTime  time.Time `json:"mtime"`
+	Detected time.Time `json:"detected"`
+}
+
+// scrubEntry is one file in the checksum manifest
+type scrubEntry struct {
+	SHA256   string         `json:"sha256"`
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mtime"`
+	Verified time.Time      `json:"verified"`
+	Mismatch *ScrubMismatch `json:"mismatch,omitempty"`
+}
+
+// NewScrubber creates a new scrubber
+func NewScrubber(cfg *Config) *Scrubber {
+	return &Scrubber{
+		config: cfg,
+		status: ScrubStatus{
+			Enabled:    cfg.Scrub.Enabled,
+			Mismatches: []ScrubMismatch{},
+		},
+	}
+}
+
+// Status returns a copy of the current scrub status
+func (s *Scrubber) Status() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Mismatches = append([]ScrubMismatch{}, s.status.Mismatches...)
+	return status
+}
+
+// Run starts a scrub pass a minute after startup and then every interval
+// until ctx is cancelled
+func (s *Scrubber) Run(ctx context.Context) {
+	if !s.config.Scrub.Enabled {
+		return
+	}
+
+	// Load known mismatches so they survive restarts
+	if manifest, err := s.loadManifest(); err == nil {
+		s.mu.Lock()
+		s.status.Mismatches = collectMismatches(manifest)
+		s.mu.Unlock()
+	}
+
+	// Passes are incremental, so the first one need not wait an interval
+	next := time.Now().Add(time.Minute)
+	for {
+		s.mu.Lock()
+		s.status.NextRun = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := s.Scrub(ctx); err != nil {
+			storageLog.Error("Scrub failed", "error", err)
+		}
+		next = time.Now().Add(s.config.Scrub.Interval)
+	}
+}
+
+// Scrub runs a single incremental scrub pass
+func (s *Scrubber) Scrub(ctx context.Context) error {
+	s.mu.Lock()
+	if s.status.Running {
+		s.mu.Unlock()
+		return fmt.Errorf("scrub already running")
+	}
+	s.status.Running = true
+	s.status.Hashed = 0
+	s.status.Verified = 0
+	s.status.BytesRead = 0
+	s.mu.Unlock()
+
+	start := time.Now()
+	err := s.scrub(ctx)
+
+	s.mu.Lock()
+	s.status.Running = false
+	s.status.LastRun = start
+	s.status.LastDuration = time.Since(start).Round(time.Second).String()
+	if err != nil {
+		s.status.LastError = err.Error()
+	} else {
+		s.status.LastError = ""
+	}
+	mismatches := len(s.status.Mismatches)
+	s.mu.Unlock()
+
+	if err == nil {
+		storageLog.Info("Scrub pass complete", "duration", time.Since(start).Round(time.Second), "mismatches", mismatches)
+	}
+	return err
+}
+
+func (s *Scrubber) scrub(ctx context.Context) error {
+	root := s.config.Storage.Path
+	if err := checkStorage(root); err != nil {
+		return err
+	}
+
+	manifest, err := s.loadManifest()
+	if err != nil {
+		return err
+	}
+
+	limiter := &scrubLimiter{rate: s.config.Scrub.RateLimit, start: time.Now()}
+	seen := make(map[string]bool, len(manifest))
+	files := 0
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable subtrees are skipped rather than aborting the pass
+			storageLog.Warn("Scrub skipping file", "path", path, "error", err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if strings.HasPrefix(d.Name(), ".ctrlsrv") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		files++
+
+		entry, known := manifest[rel]
+		changed := !known || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime())
+		if !changed && time.Since(entry.Verified) < s.config.Scrub.MaxAge {
+			return nil
+		}
+
+		sum, n, err := hashFileThrottled(ctx, path, limiter)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			storageLog.Warn("Scrub failed to read file", "path", rel, "error", err)
+			return nil
+		}
+
+		now := time.Now()
+		s.mu.Lock()
+		s.status.BytesRead += uint64(n)
+		if changed {
+			s.status.Hashed++
+		} else {
+			s.status.Verified++
+		}
+		s.mu.Unlock()
+
+		if changed {
+			// Edited (or new) file: record the new content as the reference
+			manifest[rel] = &scrubEntry{SHA256: sum, Size: info.Size(), ModTime: info.ModTime(), Verified: now}
+			return nil
+		}
+
+		entry.Verified = now
+		if sum != entry.SHA256 {
+			if entry.Mismatch == nil || entry.Mismatch.Actual != sum {
+				storageLog.Error("Scrub detected silent content change", "path", rel)
+				entry.Mismatch = &ScrubMismatch{
+					Path:     rel,
+					Expected: entry.SHA256,
+					Actual:   sum,
+					ModTime:  info.ModTime(),
+					Detected: now,
+				}
+			}
+		} else {
+			entry.Mismatch = nil
+		}
+		return nil
+	})
+
+	// Forget files that no longer exist, unless the walk was cut short
+	if err == nil {
+		for rel := range manifest {
+			if !seen[rel] {
+				delete(manifest, rel)
+			}
+		}
+	}
+
+	// Always persist progress so an interrupted pass is not wasted
+	if saveErr := s.saveManifest(manifest); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	s.mu.Lock()
+	s.status.Files = files
+	s.status.Mismatches = collectMismatches(manifest)
+	s.mu.Unlock()
+
+	return err
+}
+
+// Accept records the current content of a mismatched file as correct
+func (s *Scrubber) Accept(rel string) error {
+	s.mu.Lock()
+	running := s.status.Running
+	s.mu.Unlock()
+	if running {
+		return fmt.Errorf("scrub is running")
+	}
+
+	manifest, err := s.loadManifest()
+	if err != nil {
+		return err
+	}
+	entry, ok := manifest[rel]
+	if !ok || entry.Mismatch == nil {
+		return fmt.Errorf("no mismatch recorded for %s", rel)
+	}
+	entry.SHA256 = entry.Mismatch.Actual
+	entry.Mismatch = nil
+	if err := s.saveManifest(manifest); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.status.Mismatches = collectMismatches(manifest)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Scrubber) manifestPath() string {
+	return filepath.Join(s.config.GetStateDir(), "scrub-manifest.json")
+}
+
+func (s *Scrubber) loadManifest() (map[string]*scrubEntry, error) {
+	manifest := make(map[string]*scrubEntry)
+	data, err := os.ReadFile(s.manifestPath())
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scrub manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse scrub manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+func (s *Scrubber) saveManifest(manifest map[string]*scrubEntry) error {
+	if err := os.MkdirAll(s.config.GetStateDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.manifestPath(), data, 0644)
+}
+
+// collectMismatches returns all recorded mismatches sorted by path
+func collectMismatches(manifest map[string]*scrubEntry) []ScrubMismatch {
+	mismatches := []ScrubMismatch{}
+	for _, entry := range manifest {
+		if entry.Mismatch != nil {
+			mismatches = append(mismatches, *entry.Mismatch)
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Path < mismatches[j].Path })
+	return mismatches
+}
+
+// scrubLimiter throttles reads to a number of bytes per second
+type scrubLimiter struct {
+	rate  int64
+	start time.Time
+	total int64
+}
+
+// wait blocks until n more bytes may be read without exceeding the rate
+func (l *scrubLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.total += int64(n)
+	allowed := time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second))
+	if sleep := allowed - time.Since(l.start); sleep > 0 {
+		timer := time.NewTimer(sleep)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// hashFileThrottled computes the SHA-256 of a file at a limited read rate
+func hashFileThrottled(ctx context.Context, path string, limiter *scrubLimiter) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	buf := make([]byte, 256<<10)
+	var total int64
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			total += int64(n)
+			if err := limiter.wait(ctx, n); err != nil {
+				return "", total, err
+			}
+		}
+		if err == io.EOF {
+			return hex.EncodeToString(h.Sum(nil)), total, nil
+		}
+		if err != nil {
+			return "", total, err
+		}
+	}
+}
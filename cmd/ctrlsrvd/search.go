@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const (
+	// searchContentLimit caps the extracted text kept per document
+	searchContentLimit = 64 << 10
+
+	// searchTextReadLimit caps how much of a plain text file is read
+	searchTextReadLimit = 256 << 10
+)
+
+// File type categories used for search filters and previews
+const (
+	FileTypeDocument = "document"
+	FileTypeImage    = "image"
+	FileTypeVideo    = "video"
+	FileTypeAudio    = "audio"
+	FileTypeArchive  = "archive"
+	FileTypeOther    = "other"
+)
+
+var fileTypeByExt = map[string]string{
+	".pdf": FileTypeDocument, ".txt": FileTypeDocument, ".md": FileTypeDocument,
+	".doc": FileTypeDocument, ".docx": FileTypeDocument, ".odt": FileTypeDocument,
+	".rtf": FileTypeDocument, ".csv": FileTypeDocument, ".xls": FileTypeDocument,
+	".xlsx": FileTypeDocument, ".ods": FileTypeDocument, ".html": FileTypeDocument,
+	".jpg": FileTypeImage, ".jpeg": FileTypeImage, ".png": FileTypeImage,
+	".gif": FileTypeImage, ".heic": FileTypeImage, ".webp": FileTypeImage,
+	".tif": FileTypeImage, ".tiff": FileTypeImage, ".bmp": FileTypeImage,
+	".mp4": FileTypeVideo, ".mov": FileTypeVideo, ".mkv": FileTypeVideo,
+	".avi": FileTypeVideo, ".webm": FileTypeVideo,
+	".mp3": FileTypeAudio, ".flac": FileTypeAudio, ".ogg": FileTypeAudio,
+	".wav": FileTypeAudio, ".m4a": FileTypeAudio,
+	".zip": FileTypeArchive, ".tar": FileTypeArchive, ".gz": FileTypeArchive,
+	".7z": FileTypeArchive, ".rar": FileTypeArchive,
+}
+
+// plainTextExts are indexed by reading the file directly
+var plainTextExts = map[string]bool{
+	".txt": true, ".md": true, ".csv": true, ".log": true, ".json": true,
+	".xml": true, ".html": true, ".yaml": true, ".yml": true, ".ini": true,
+	".conf": true,
+}
+
+// fileType returns the category of a file based on its extension
+func fileType(name string) string {
+	if t, ok := fileTypeByExt[strings.ToLower(filepath.Ext(name))]; ok {
+		return t
+	}
+	return FileTypeOther
+}
+
+// SearchIndex is an in-memory filename, path and content index of the
+// primary storage volume. It is persisted to the state directory so text
+// extraction does not have to be repeated after a restart, and kept fresh
+// with inotify plus a periodic full rescan.
+type SearchIndex struct {
+	config   atomic.Pointer[Config]
+	reloaded chan struct{}
+
+	mu       sync.RWMutex
+	docs     map[string]*searchDoc
+	terms    map[string]map[string]struct{}
+	ready    bool
+	lastScan time.Time
+	dirty    bool
+
+	pendingMu sync.Mutex
+	pending   map[string]bool
+}
+
+// searchDoc is one indexed file
+type searchDoc struct {
+	Path    string
+	Type    string
+	Size    int64
+	ModTime time.Time
+	Content string
+}
+
+// SearchQuery holds search terms and filters
+type SearchQuery struct {
+	Text   string
+	Type   string
+	Folder string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// SearchResult is a single search hit
+type SearchResult struct {
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Snippet string    `json:"snippet,omitempty"`
+	score   int
+}
+
+// NewSearchIndex creates a new, empty search index
+func NewSearchIndex(cfg *Config) *SearchIndex {
+	idx := &SearchIndex{
+		reloaded: make(chan struct{}, 1),
+		docs:     make(map[string]*searchDoc),
+		terms:    make(map[string]map[string]struct{}),
+		pending:  make(map[string]bool),
+	}
+	idx.config.Store(cfg)
+	return idx
+}
+
+// SetConfig applies reloaded search settings. Turning search on or off and
+// changing the rescan interval take effect without a restart.
+func (idx *SearchIndex) SetConfig(cfg *Config) {
+	idx.config.Store(cfg)
+	select {
+	case idx.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the number of indexed documents and whether the initial scan is done
+func (idx *SearchIndex) Stats() (docs int, ready bool, lastScan time.Time) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs), idx.ready, idx.lastScan
+}
+
+// Run builds the index and keeps it up to date until ctx is cancelled,
+// starting and stopping as search is enabled and disabled
+func (idx *SearchIndex) Run(ctx context.Context) {
+	loaded := false
+	for {
+		if idx.config.Load().Search.Enabled {
+			if !loaded {
+				if err := idx.load(); err != nil {
+					searchLog.Info("Search index cache not loaded", "error", err)
+				}
+				loaded = true
+			}
+			runCtx, cancel := context.WithCancel(ctx)
+			idx.run(runCtx)
+			cancel()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-idx.reloaded:
+		}
+	}
+}
+
+// run indexes until ctx is cancelled or search is disabled
+func (idx *SearchIndex) run(ctx context.Context) {
+	cfg := idx.config.Load()
+	root := cfg.Storage.Path
+	go func() {
+		skip := func(name string) bool { return strings.HasPrefix(name, ".") }
+		if err := watchTree(ctx, root, skip, idx.markPending); err != nil {
+			searchLog.Warn("Inotify unavailable, relying on rescans", "error", err)
+		}
+	}()
+
+	idx.scan(ctx)
+
+	interval := cfg.Search.RescanInterval
+	rescan := time.NewTicker(interval)
+	defer rescan.Stop()
+	debounce := time.NewTicker(2 * time.Second)
+	defer debounce.Stop()
+	persist := time.NewTicker(time.Minute)
+	defer persist.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			idx.save()
+			return
+		case <-rescan.C:
+			idx.scan(ctx)
+		case <-debounce.C:
+			idx.processPending(ctx)
+		case <-persist.C:
+			idx.save()
+		case <-idx.reloaded:
+			cfg := idx.config.Load()
+			if !cfg.Search.Enabled {
+				idx.save()
+				searchLog.Info("Search disabled")
+				return
+			}
+			if cfg.Search.RescanInterval != interval {
+				interval = cfg.Search.RescanInterval
+				rescan.Reset(interval)
+				searchLog.Info("Search rescan interval changed", "interval", interval)
+			}
+		}
+	}
+}
+
+func (idx *SearchIndex) markPending(path string) {
+	idx.pendingMu.Lock()
+	idx.pending[path] = true
+	idx.pendingMu.Unlock()
+}
+
+// processPending re-indexes paths reported by the watcher
+func (idx *SearchIndex) processPending(ctx context.Context) {
+	idx.pendingMu.Lock()
+	pending := idx.pending
+	idx.pending = make(map[string]bool)
+	idx.pendingMu.Unlock()
+
+	root := idx.config.Load().Storage.Path
+	for path := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") || strings.HasPrefix(filepath.Base(rel), ".") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Symlinks are not followed, as in the full scan
+		info, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			// Deleted or moved away: drop the file or the whole subtree
+			idx.removePrefix(rel)
+		case info.IsDir():
+			idx.indexTree(ctx, path, nil)
+		case info.Mode().IsRegular():
+			idx.indexFile(path, rel, info)
+		default:
+			idx.removePrefix(rel)
+		}
+	}
+}
+
+// scan reconciles the index with the filesystem
+func (idx *SearchIndex) scan(ctx context.Context) {
+	root := idx.config.Load().Storage.Path
+	if err := checkStorage(root); err != nil {
+		searchLog.Warn("Skipping scan", "error", err)
+		return
+	}
+
+	start := time.Now()
+	seen := make(map[string]bool)
+	if err := idx.indexTree(ctx, root, seen); err != nil {
+		return
+	}
+
+	idx.mu.Lock()
+	for rel := range idx.docs {
+		if !seen[rel] {
+			idx.removeLocked(rel)
+		}
+	}
+	idx.ready = true
+	idx.lastScan = time.Now()
+	count := len(idx.docs)
+	idx.mu.Unlock()
+
+	idx.save()
+	searchLog.Info("Search index scan complete", "files", count, "duration", time.Since(start).Round(time.Millisecond))
+}
+
+// indexTree indexes all changed files below dir, recording visited paths in seen
+func (idx *SearchIndex) indexTree(ctx context.Context, dir string, seen map[string]bool) error {
+	root := idx.config.Load().Storage.Path
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if seen != nil {
+			seen[rel] = true
+		}
+		idx.indexFile(path, rel, info)
+		return nil
+	})
+}
+
+// indexFile (re)indexes a single file if it changed since it was last indexed
+func (idx *SearchIndex) indexFile(path, rel string, info fs.FileInfo) {
+	idx.mu.RLock()
+	existing, ok := idx.docs[rel]
+	idx.mu.RUnlock()
+	if ok && existing.Size == info.Size() && existing.ModTime.Equal(info.ModTime()) {
+		return
+	}
+
+	doc := &searchDoc{
+		Path:    rel,
+		Type:    fileType(rel),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Content: extractText(path),
+	}
+
+	idx.mu.Lock()
+	idx.removeLocked(rel)
+	idx.docs[rel] = doc
+	for term := range docTerms(doc) {
+		postings, ok := idx.terms[term]
+		if !ok {
+			postings = make(map[string]struct{})
+			idx.terms[term] = postings
+		}
+		postings[rel] = struct{}{}
+	}
+	idx.dirty = true
+	idx.mu.Unlock()
+}
+
+// removePrefix drops a file or every file below a directory
+func (idx *SearchIndex) removePrefix(rel string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for path := range idx.docs {
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			idx.removeLocked(path)
+		}
+	}
+}
+
+func (idx *SearchIndex) removeLocked(rel string) {
+	doc, ok := idx.docs[rel]
+	if !ok {
+		return
+	}
+	for term := range docTerms(doc) {
+		if postings, ok := idx.terms[term]; ok {
+			delete(postings, rel)
+			if len(postings) == 0 {
+				delete(idx.terms, term)
+			}
+		}
+	}
+	delete(idx.docs, rel)
+	idx.dirty = true
+}
+
+// Search returns documents matching all query terms and filters
+func (idx *SearchIndex) Search(q SearchQuery) ([]SearchResult, int) {
+	tokens := tokenize(q.Text)
+	folder := strings.Trim(filepath.ToSlash(q.Folder), "/")
+	if q.Limit <= 0 || q.Limit > 500 {
+		q.Limit = 50
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Intersect postings of terms matching each query token as a prefix
+	var candidates map[string]struct{}
+	for _, token := range tokens {
+		matched := make(map[string]struct{})
+		for term, postings := range idx.terms {
+			if strings.HasPrefix(term, token) {
+				for rel := range postings {
+					if candidates == nil {
+						matched[rel] = struct{}{}
+					} else if _, ok := candidates[rel]; ok {
+						matched[rel] = struct{}{}
+					}
+				}
+			}
+		}
+		candidates = matched
+		if len(candidates) == 0 {
+			return []SearchResult{}, 0
+		}
+	}
+	if candidates == nil {
+		if q.Type == "" && folder == "" && q.From.IsZero() && q.To.IsZero() {
+			return []SearchResult{}, 0
+		}
+		candidates = make(map[string]struct{}, len(idx.docs))
+		for rel := range idx.docs {
+			candidates[rel] = struct{}{}
+		}
+	}
+
+	results := []SearchResult{}
+	for rel := range candidates {
+		doc := idx.docs[rel]
+		if q.Type != "" && doc.Type != q.Type {
+			continue
+		}
+		if folder != "" && !strings.HasPrefix(rel, folder+"/") {
+			continue
+		}
+		if !q.From.IsZero() && doc.ModTime.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !doc.ModTime.Before(q.To) {
+			continue
+		}
+
+		name := filepath.Base(rel)
+		result := SearchResult{
+			Path:    rel,
+			Name:    name,
+			Type:    doc.Type,
+			Size:    doc.Size,
+			ModTime: doc.ModTime,
+		}
+		lowerName, lowerPath := strings.ToLower(name), strings.ToLower(rel)
+		for _, token := range tokens {
+			switch {
+			case strings.Contains(lowerName, token):
+				result.score += 10
+			case strings.Contains(lowerPath, token):
+				result.score += 3
+			default:
+				result.score++
+				if result.Snippet == "" {
+					result.Snippet = snippet(doc.Content, token)
+				}
+			}
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].ModTime.After(results[j].ModTime)
+	})
+
+	total := len(results)
+	if total > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, total
+}
+
+func (idx *SearchIndex) cachePath() string {
+	return filepath.Join(idx.config.Load().GetStateDir(), "search-index.gob")
+}
+
+// load restores the index from the on-disk cache
+func (idx *SearchIndex) load() error {
+	f, err := os.Open(idx.cachePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var docs map[string]*searchDoc
+	if err := gob.NewDecoder(f).Decode(&docs); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.docs = docs
+	idx.terms = make(map[string]map[string]struct{})
+	for rel, doc := range docs {
+		for term := range docTerms(doc) {
+			postings, ok := idx.terms[term]
+			if !ok {
+				postings = make(map[string]struct{})
+				idx.terms[term] = postings
+			}
+			postings[rel] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// save writes the index to the on-disk cache if it changed
+func (idx *SearchIndex) save() {
+	idx.mu.Lock()
+	if !idx.dirty {
+		idx.mu.Unlock()
+		return
+	}
+	idx.dirty = false
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(idx.docs)
+	idx.mu.Unlock()
+	if err != nil {
+		searchLog.Error("Failed to encode search index", "error", err)
+		return
+	}
+
+	if err := os.MkdirAll(idx.config.Load().GetStateDir(), 0755); err != nil {
+		searchLog.Error("Failed to save search index", "error", err)
+		return
+	}
+	if err := writeFileAtomic(idx.cachePath(), buf.Bytes(), 0644); err != nil {
+		searchLog.Error("Failed to save search index", "error", err)
+	}
+}
+
+// docTerms returns the set of terms a document is indexed under
+func docTerms(doc *searchDoc) map[string]struct{} {
+	terms := make(map[string]struct{})
+	for _, t := range tokenize(doc.Path) {
+		terms[t] = struct{}{}
+	}
+	for _, t := range tokenize(doc.Content) {
+		terms[t] = struct{}{}
+	}
+	return terms
+}
+
+// tokenize lowercases text and splits it into words of two or more characters
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	tokens := words[:0]
+	for _, w := range words {
+		if len([]rune(w)) >= 2 {
+			tokens = append(tokens, w)
+		}
+	}
+	return tokens
+}
+
+// snippet returns text surrounding the first occurrence of token
+func snippet(content, token string) string {
+	lower := strings.ToLower(content)
+	i := strings.Index(lower, token)
+	if i < 0 {
+		return ""
+	}
+	start, end := max(i-60, 0), min(i+len(token)+60, len(content))
+	// Avoid cutting multi-byte characters in half
+	for start > 0 && !utf8RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8RuneStart(content[end]) {
+		end++
+	}
+	return strings.Join(strings.Fields(content[start:end]), " ")
+}
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// extractText returns searchable text for a file, or "" if none can be extracted
+func extractText(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	var text string
+
+	switch {
+	case plainTextExts[ext]:
+		f, err := os.Open(path)
+		if err != nil {
+			return ""
+		}
+		data, _ := io.ReadAll(io.LimitReader(f, searchTextReadLimit))
+		f.Close()
+		text = string(data)
+	case ext == ".pdf":
+		if _, err := exec.LookPath("pdftotext"); err != nil {
+			return ""
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "pdftotext", "-q", "-l", "20", path, "-").Output()
+		if err != nil {
+			return ""
+		}
+		text = string(out)
+	default:
+		return ""
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > searchContentLimit {
+		text = strings.ToValidUTF8(text[:searchContentLimit], "")
+	}
+	return text
+}
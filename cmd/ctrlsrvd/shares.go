@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errShareNotFound = errors.New("share link not found")
+	errShareExpired  = errors.New("share link has expired")
+	errShareRevoked  = errors.New("share link has been revoked")
+	errShareLimit    = errors.New("share link download limit reached")
+)
+
+// Share is a signed, expiring link to a file or folder on storage
+type Share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	IsDir        bool      `json:"is_dir"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	LastAccess   time.Time `json:"last_access,omitempty"`
+	Revoked      bool      `json:"revoked"`
+}
+
+// ShareInfo is the public view of a share returned by the admin API
+type ShareInfo struct {
+	ID           string    `json:"id"`
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	IsDir        bool      `json:"is_dir"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	HasPassword  bool      `json:"has_password"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	LastAccess   time.Time `json:"last_access,omitempty"`
+	Revoked      bool      `json:"revoked"`
+	Expired      bool      `json:"expired"`
+}
+
+// ShareManager creates, verifies and revokes share links. Shares are kept
+// in a JSON file in the state directory and the signing secret in
+// shares.key_file; tokens are the share ID plus an
+// HMAC over the ID and expiry, so forged or altered links are rejected
+// before any lookup.
+type ShareManager struct {
+	config atomic.Pointer[Config]
+
+	mu     sync.Mutex
+	shares map[string]*Share
+	secret []byte
+	loaded bool
+}
+
+// NewShareManager creates a new share manager
+func NewShareManager(cfg *Config) *ShareManager {
+	m := &ShareManager{
+		shares: make(map[string]*Share),
+	}
+	m.config.Store(cfg)
+	return m
+}
+
+// SetConfig applies reloaded share settings to shares created afterwards
+func (m *ShareManager) SetConfig(cfg *Config) {
+	m.config.Store(cfg)
+}
+
+func (m *ShareManager) dbPath() string {
+	return filepath.Join(m.config.Load().GetStateDir(), "shares.json")
+}
+
+func (m *ShareManager) secretPath() string {
+	return m.config.Load().Shares.KeyFile
+}
+
+// load reads shares and the signing secret on first use. Caller holds m.mu.
+func (m *ShareManager) load() error {
+	if m.loaded {
+		return nil
+	}
+	if err := os.MkdirAll(m.config.Load().GetStateDir(), 0755); err != nil {
+		return err
+	}
+	if err := moveFromStateDir(m.config.Load(), "shares.key", m.secretPath()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.secretPath()), 0700); err != nil {
+		return err
+	}
+
+	secret, err := os.ReadFile(m.secretPath())
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(m.secretPath(), secret, 0600); err != nil {
+			return fmt.Errorf("failed to write share secret: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read share secret: %w", err)
+	}
+
+	data, err := os.ReadFile(m.dbPath())
+	if err == nil {
+		var shares []*Share
+		if err := json.Unmarshal(data, &shares); err != nil {
+			return fmt.Errorf("failed to parse shares: %w", err)
+		}
+		for _, sh := range shares {
+			m.shares[sh.ID] = sh
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read shares: %w", err)
+	}
+
+	m.secret = secret
+	m.loaded = true
+	return nil
+}
+
+// Check reports whether the share store loads and the public URL of cfg
+// can be used to build links
+func (m *ShareManager) Check(cfg *Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	if cfg.Shares.PublicURL == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Shares.PublicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("shares.public_url is not an absolute http(s) URL: %q", cfg.Shares.PublicURL)
+	}
+	return nil
+}
+
+// save persists all shares. Caller holds m.mu.
+func (m *ShareManager) save() error {
+	shares := make([]*Share, 0, len(m.shares))
+	for _, sh := range m.shares {
+		shares = append(shares, sh)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.dbPath(), data, 0600)
+}
+
+// sign returns the token for a share
+func (m *ShareManager) sign(sh *Share) string {
+	mac := hmac.New(sha256.New, m.secret)
+	fmt.Fprintf(mac, "%s|%d", sh.ID, sh.Expires.Unix())
+	return sh.ID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+func (m *ShareManager) info(sh *Share) ShareInfo {
+	return ShareInfo{
+		ID:           sh.ID,
+		Token:        m.sign(sh),
+		Path:         sh.Path,
+		IsDir:        sh.IsDir,
+		Created:      sh.Created,
+		Expires:      sh.Expires,
+		HasPassword:  sh.PasswordHash != "",
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		LastAccess:   sh.LastAccess,
+		Revoked:      sh.Revoked,
+		Expired:      time.Now().After(sh.Expires),
+	}
+}
+
+// Create makes a new share for rel (relative to storage)
+func (m *ShareManager) Create(rel string, ttl time.Duration, password string, maxDownloads int) (ShareInfo, error) {
+	cfg := m.config.Load()
+	if ttl <= 0 {
+		ttl = cfg.Shares.DefaultTTL
+	}
+	if ttl > cfg.Shares.MaxTTL {
+		return ShareInfo{}, fmt.Errorf("expiry exceeds maximum of %s", cfg.Shares.MaxTTL)
+	}
+	if cleanStorageRel(rel) == "" {
+		return ShareInfo{}, fmt.Errorf("the storage root cannot be shared")
+	}
+	full, err := resolveUserPath(cfg, rel)
+	if err != nil {
+		return ShareInfo{}, err
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		return ShareInfo{}, err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return ShareInfo{}, fmt.Errorf("only files and folders can be shared")
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return ShareInfo{}, err
+	}
+	sh := &Share{
+		ID:           hex.EncodeToString(id),
+		Path:         strings.Trim(filepath.ToSlash(filepath.Clean("/"+rel)), "/"),
+		IsDir:        info.IsDir(),
+		Created:      time.Now(),
+		Expires:      time.Now().Add(ttl),
+		MaxDownloads: maxDownloads,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return ShareInfo{}, err
+		}
+		sh.PasswordHash = string(hash)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return ShareInfo{}, err
+	}
+	m.shares[sh.ID] = sh
+	if err := m.save(); err != nil {
+		delete(m.shares, sh.ID)
+		return ShareInfo{}, err
+	}
+
+	authLog.Info("Created share", "share", sh.ID, "path", sh.Path, "expires", sh.Expires.Format(time.RFC3339))
+	return m.info(sh), nil
+}
+
+// List returns all shares, newest first
+func (m *ShareManager) List() ([]ShareInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	list := make([]ShareInfo, 0, len(m.shares))
+	for _, sh := range m.shares {
+		list = append(list, m.info(sh))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, nil
+}
+
+// Revoke disables a share permanently
+func (m *ShareManager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	sh, ok := m.shares[id]
+	if !ok {
+		return errShareNotFound
+	}
+	sh.Revoked = true
+	authLog.Info("Revoked share", "share", sh.ID, "path", sh.Path)
+	return m.save()
+}
+
+// Resolve verifies a token and returns a copy of its share
+func (m *ShareManager) Resolve(token string) (Share, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return Share{}, errShareNotFound
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return Share{}, err
+	}
+	sh, ok := m.shares[id]
+	if !ok || !hmac.Equal([]byte(m.sign(sh)), []byte(token)) {
+		return Share{}, errShareNotFound
+	}
+	switch {
+	case sh.Revoked:
+		return Share{}, errShareRevoked
+	case time.Now().After(sh.Expires):
+		return Share{}, errShareExpired
+	case sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads:
+		return Share{}, errShareLimit
+	}
+	return *sh, nil
+}
+
+// CheckPassword reports whether password unlocks the share
+func (m *ShareManager) CheckPassword(sh Share, password string) bool {
+	if sh.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(sh.PasswordHash), []byte(password)) == nil
+}
+
+// UnlockCookie returns the cookie value proving the share password was entered
+func (m *ShareManager) UnlockCookie(sh Share) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mac := hmac.New(sha256.New, m.secret)
+	fmt.Fprintf(mac, "unlock|%s|%s", sh.ID, sh.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CountDownload records a download of a share
+func (m *ShareManager) CountDownload(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sh, ok := m.shares[id]; ok {
+		sh.Downloads++
+		sh.LastAccess = time.Now()
+		if err := m.save(); err != nil {
+			authLog.Error("Failed to save share download count", "error", err)
+		}
+	}
+}
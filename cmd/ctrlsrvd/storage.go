@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 // checkStorage verifies that the storage path is mounted and accessible
@@ -36,6 +38,80 @@ func checkStorage(path string) error {
 	return nil
 }
 
+// resolveStoragePath joins a user-supplied relative path onto root and
+// rejects anything that would escape it
+func resolveStoragePath(root, rel string) (string, error) {
+	cleaned := filepath.Clean("/" + filepath.FromSlash(rel))
+	full := filepath.Join(root, cleaned)
+	if full != filepath.Clean(root) && !strings.HasPrefix(full, filepath.Clean(root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes storage root: %s", rel)
+	}
+	return full, nil
+}
+
+// resolveUserPath resolves a path given by a user of the web UI or API.
+// Hidden files and folders are refused, and with them the state directory,
+// so users cannot reach credentials, keys or the audit log.
+func resolveUserPath(cfg *Config, rel string) (string, error) {
+	if isHiddenRel(rel) {
+		return "", fmt.Errorf("hidden path not allowed: %s", rel)
+	}
+	full, err := resolveStoragePath(cfg.Storage.Path, rel)
+	if err != nil {
+		return "", err
+	}
+	state := filepath.Clean(cfg.GetStateDir())
+	if full == state || strings.HasPrefix(full, state+string(filepath.Separator)) {
+		return "", fmt.Errorf("path is in the state directory: %s", rel)
+	}
+	if err := checkNoSymlinks(cfg.Storage.Path, full); err != nil {
+		return "", err
+	}
+	return full, nil
+}
+
+// checkNoSymlinks refuses full if any part of it below root is a symbolic
+// link. The daemon runs as root, so following one would let a link placed
+// on a share read or write anywhere. Parts that do not exist yet pass.
+func checkNoSymlinks(root, full string) error {
+	rel, err := filepath.Rel(filepath.Clean(root), full)
+	if err != nil || rel == "." {
+		return err
+	}
+	cur := filepath.Clean(root)
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("symbolic links are not followed: %s", filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+// isHiddenRel reports whether any component of a cleaned relative path
+// starts with a dot
+func isHiddenRel(rel string) bool {
+	for _, part := range strings.Split(cleanStorageRel(rel), "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanStorageRel normalizes a storage-relative path to slash form without
+// leading or trailing separators
+func cleanStorageRel(rel string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean("/"+rel)), "/")
+}
+
 // formatBytes converts bytes to human-readable format
 func formatBytes(bytes uint64) string {
 	const unit = 1024
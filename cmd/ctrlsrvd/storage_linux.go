@@ -49,3 +49,19 @@ func isMountpoint(path string) bool {
 	// If device IDs differ, it's a mountpoint
 	return pathStat.Dev != parentStat.Dev
 }
+
+// fileID returns the device and inode of a file so hardlinks can be
+// recognised as the same file (Linux)
+func fileID(info os.FileInfo) ([2]uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{uint64(st.Dev), st.Ino}, true
+}
+
+// openNoFollow opens path for reading, failing if the final component is
+// a symbolic link (Linux)
+func openNoFollow(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// thumbMaxPixels guards against decoding huge images into memory
+const thumbMaxPixels = 64 << 20
+
+// thumbSizes are the supported thumbnail bounding boxes in pixels
+var thumbSizes = []int{128, 256, 512}
+
+// errNoThumbnail is returned for files that cannot be previewed
+var errNoThumbnail = errors.New("no thumbnail available for this file type")
+
+// ThumbnailService generates and caches JPEG thumbnails for images and the
+// first page of PDFs on the primary storage volume.
+//
+// Thumbnails are cached under the state directory, named by a hash of the
+// file path, size, mtime and thumbnail size, so edits invalidate them and
+// the name doubles as an ETag.
+type ThumbnailService struct {
+	config *Config
+
+	// sem limits concurrent generation; decoding large photos is memory hungry
+	sem chan struct{}
+}
+
+// NewThumbnailService creates a new thumbnail service
+func NewThumbnailService(cfg *Config) *ThumbnailService {
+	return &ThumbnailService{
+		config: cfg,
+		sem:    make(chan struct{}, 2),
+	}
+}
+
+// normalizeThumbSize rounds a requested size up to a supported one
+func normalizeThumbSize(size int) int {
+	for _, s := range thumbSizes {
+		if size <= s {
+			return s
+		}
+	}
+	return thumbSizes[len(thumbSizes)-1]
+}
+
+// Thumbnail returns the path of a cached thumbnail for rel (relative to
+// storage), generating it if needed, along with its ETag. Hidden files and
+// symbolic links are refused.
+func (t *ThumbnailService) Thumbnail(ctx context.Context, rel string, size int) (string, string, error) {
+	src, err := resolveUserPath(t.config, rel)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", "", errNoThumbnail
+	}
+
+	size = normalizeThumbSize(size)
+	etag := thumbKey(rel, info, size)
+	cached := t.cachePath(etag)
+
+	if _, err := os.Stat(cached); err == nil {
+		// Touch so pruning keeps thumbnails that are still in use
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		return cached, etag, nil
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+		defer func() { <-t.sem }()
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+
+	// Another request may have generated it while we waited
+	if _, err := os.Stat(cached); err == nil {
+		return cached, etag, nil
+	}
+	if err := t.generate(ctx, src, cached, size); err != nil {
+		return "", "", err
+	}
+	return cached, etag, nil
+}
+
+// thumbKey derives the cache key for a file version at a given size
+func thumbKey(rel string, info fs.FileInfo, size int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", rel, info.Size(), info.ModTime().UnixNano(), size)))
+	return hex.EncodeToString(h[:16])
+}
+
+func (t *ThumbnailService) cacheDir() string {
+	return filepath.Join(t.config.GetStateDir(), "thumbs")
+}
+
+func (t *ThumbnailService) cachePath(key string) string {
+	return filepath.Join(t.cacheDir(), key[:2], key+".jpg")
+}
+
+// generate renders a thumbnail of src into dst. Each attempt writes its
+// own temporary file, so concurrent requests for the same thumbnail do not
+// clobber each other.
+func (t *ThumbnailService) generate(ctx context.Context, src, dst string, size int) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*.jpg")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	ext := strings.ToLower(filepath.Ext(src))
+	switch {
+	case ext == ".pdf":
+		err = renderPDFThumbnail(ctx, src, tmp, size)
+	case ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif":
+		err = renderImageThumbnail(src, tmp, size)
+	case fileType(src) == FileTypeImage:
+		// Formats the standard library cannot decode (HEIC, WebP, TIFF)
+		err = renderExternalThumbnail(ctx, src, tmp, size)
+	default:
+		err = errNoThumbnail
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// renderImageThumbnail decodes an image with the standard library and
+// writes a downscaled JPEG
+func renderImageThumbnail(src, dst string, size int) error {
+	f, err := openNoFollow(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("unsupported image: %w", err)
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return fmt.Errorf("image too large to preview: %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	thumb := scaleImage(img, size)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// scaleImage downscales img to fit within size x size using box filtering
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	dw, dh := size, size
+	if w > h {
+		dh = max(h*size/w, 1)
+	} else {
+		dw = max(w*size/h, 1)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := max(b.Min.Y+(y+1)*h/dh, y0+1)
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := max(b.Min.X+(x+1)*w/dw, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// renderPDFThumbnail renders the first page of a PDF with pdftoppm
+func renderPDFThumbnail(ctx context.Context, src, dst string, size int) error {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		return fmt.Errorf("pdftoppm not installed (apt install poppler-utils)")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// pdftoppm appends .jpg to the output prefix itself
+	prefix := strings.TrimSuffix(dst, ".jpg")
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-singlefile",
+		"-jpeg", "-scale-to", fmt.Sprint(size), src, prefix)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pdftoppm failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// renderExternalThumbnail uses ImageMagick for formats Go cannot decode
+func renderExternalThumbnail(ctx context.Context, src, dst string, size int) error {
+	if _, err := exec.LookPath("convert"); err != nil {
+		return errNoThumbnail
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	geometry := fmt.Sprintf("%dx%d>", size, size)
+	cmd := exec.CommandContext(ctx, "convert", src+"[0]", "-auto-orient", "-thumbnail", geometry, "-quality", "80", dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("convert failed: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Run pre-generates thumbnails for the configured folders and prunes stale
+// cache entries until ctx is cancelled
+func (t *ThumbnailService) Run(ctx context.Context) {
+	if !t.config.Thumbnails.Enabled {
+		return
+	}
+
+	changed := make(chan string, 64)
+	for _, rel := range t.config.Thumbnails.Pregenerate {
+		dir, err := resolveUserPath(t.config, rel)
+		if err != nil {
+			thumbsLog.Error("Invalid pregenerate directory", "path", rel, "error", err)
+			continue
+		}
+		os.MkdirAll(dir, 0755)
+		go func() {
+			skip := func(name string) bool { return strings.HasPrefix(name, ".") }
+			notify := func(path string) {
+				select {
+				case changed <- path:
+				default:
+					// Dropped events are caught by the periodic pass
+				}
+			}
+			if err := watchTree(ctx, dir, skip, notify); err != nil {
+				thumbsLog.Warn("Cannot watch directory", "path", dir, "error", err)
+			}
+		}()
+	}
+
+	t.pregenerate(ctx)
+	t.prune()
+
+	ticker := time.NewTicker(6 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case path := <-changed:
+			// Give writers (scanner, Samba) a moment to finish
+			time.Sleep(time.Second)
+			t.pregenerateFile(ctx, path)
+		case <-ticker.C:
+			t.pregenerate(ctx)
+			t.prune()
+		}
+	}
+}
+
+// pregenerate renders thumbnails for every file in the pre-generation folders
+func (t *ThumbnailService) pregenerate(ctx context.Context) {
+	for _, rel := range t.config.Thumbnails.Pregenerate {
+		dir, err := resolveUserPath(t.config, rel)
+		if err != nil {
+			continue
+		}
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || ctx.Err() != nil {
+				return filepath.SkipDir
+			}
+			if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if d.Type().IsRegular() {
+				t.pregenerateFile(ctx, path)
+			}
+			return nil
+		})
+	}
+}
+
+func (t *ThumbnailService) pregenerateFile(ctx context.Context, path string) {
+	rel, err := filepath.Rel(t.config.Storage.Path, path)
+	if err != nil || strings.HasPrefix(rel, "..") || isHiddenRel(rel) {
+		return
+	}
+	// Links reported by the watcher are skipped like in the full walk
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".pdf" && fileType(path) != FileTypeImage {
+		return
+	}
+	if _, _, err := t.Thumbnail(ctx, filepath.ToSlash(rel), 256); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		thumbsLog.Warn("Thumbnail failed", "path", rel, "error", err)
+	}
+}
+
+// prune removes cached thumbnails that have not been used within max_age
+func (t *ThumbnailService) prune() {
+	cutoff := time.Now().Add(-t.config.Thumbnails.MaxAge)
+	removed := 0
+	filepath.WalkDir(t.cacheDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().Before(cutoff) {
+			if os.Remove(path) == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	if removed > 0 {
+		thumbsLog.Info("Pruned stale thumbnails", "removed", removed)
+	}
+}
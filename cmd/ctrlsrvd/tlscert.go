@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// certReloadInterval is how often configured certificate files are checked
+// for changes. Polling also catches certbot-style symlink swaps.
+const certReloadInterval = 30 * time.Second
+
+// selfSignedValidity is the lifetime of the generated fallback certificate
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// CertStore serves the QUIC listener's certificate. It uses the configured
+// cert and key when present and reloads them when they change; otherwise it
+// uses a self-signed certificate generated once and kept in the state
+// directory, so clients can pin it across restarts, and switches to the
+// configured files once they appear.
+type CertStore struct {
+	// certFile and keyFile are the files in use; configCert and configKey
+	// the configured ones, which differ while the fallback is in use
+	certFile   string
+	keyFile    string
+	configCert string
+	configKey  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	modTime time.Time
+	// configFailed is when the configured files last failed to load, so
+	// they are only retried once they change
+	configFailed time.Time
+}
+
+// NewCertStore loads the configured certificate or the self-signed fallback
+func NewCertStore(cfg *Config) (*CertStore, error) {
+	s := &CertStore{
+		certFile:   cfg.Edge.TLSCert,
+		keyFile:    cfg.Edge.TLSKey,
+		configCert: cfg.Edge.TLSCert,
+		configKey:  cfg.Edge.TLSKey,
+	}
+
+	if s.certFile != "" && s.keyFile != "" {
+		if s.configuredExists() {
+			if err := s.load(); err != nil {
+				return nil, err
+			}
+			return s, nil
+		}
+		tlsLog.Info("TLS certificate or key not found, using self-signed certificate", "cert", s.certFile, "key", s.keyFile)
+	}
+
+	dir := filepath.Join(cfg.GetStateDir(), "tls")
+	s.certFile = filepath.Join(dir, "selfsigned-cert.pem")
+	s.keyFile = filepath.Join(dir, "selfsigned-key.pem")
+	if err := ensureSelfSigned(s.certFile, s.keyFile); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// configuredExists reports whether the configured cert and key files exist
+func (s *CertStore) configuredExists() bool {
+	_, certErr := os.Stat(s.configCert)
+	_, keyErr := os.Stat(s.configKey)
+	return s.configCert != "" && s.configKey != "" && certErr == nil && keyErr == nil
+}
+
+// useConfigured switches from the self-signed fallback to the configured
+// files once they exist, e.g. after certbot's first run
+func (s *CertStore) useConfigured() {
+	if s.certFile == s.configCert || !s.configuredExists() {
+		return
+	}
+	if !latestModTime(s.configCert, s.configKey).After(s.configFailed) {
+		return
+	}
+	fallbackCert, fallbackKey := s.certFile, s.keyFile
+	s.certFile, s.keyFile = s.configCert, s.configKey
+	if err := s.load(); err != nil {
+		tlsLog.Error("Configured TLS certificate appeared but failed to load, keeping self-signed", "error", err)
+		s.certFile, s.keyFile = fallbackCert, fallbackKey
+		s.configFailed = latestModTime(s.configCert, s.configKey)
+		return
+	}
+	tlsLog.Info("Switched from self-signed to the configured TLS certificate", "cert", s.certFile)
+}
+
+// load reads the certificate and key files
+func (s *CertStore) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	s.cert.Store(&cert)
+	s.modTime = latestModTime(s.certFile, s.keyFile)
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	tlsLog.Info("Loaded TLS certificate", "cert", s.certFile,
+		"expires", leaf.NotAfter.Format("2006-01-02"), "sha256", hex.EncodeToString(fingerprint[:]))
+	if time.Until(leaf.NotAfter) < 14*24*time.Hour {
+		tlsLog.Warn("TLS certificate expires soon", "cert", s.certFile, "expires", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// latestModTime returns the newest modification time of the given files
+func latestModTime(paths ...string) time.Time {
+	var latest time.Time
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// Watch reloads the certificate when its files change until stop is closed,
+// and retries the configured files while the fallback is in use. A broken
+// update keeps the previous certificate in service.
+func (s *CertStore) Watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.useConfigured()
+			if !latestModTime(s.certFile, s.keyFile).After(s.modTime) {
+				continue
+			}
+			if err := s.load(); err != nil {
+				tlsLog.Error("TLS certificate reload failed, keeping previous", "error", err)
+				// Don't retry the same broken files every tick
+				s.modTime = latestModTime(s.certFile, s.keyFile)
+			}
+		}
+	}
+}
+
+// ensureSelfSigned creates a self-signed certificate unless a valid one
+// already exists
+func ensureSelfSigned(certFile, keyFile string) error {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 30*24*time.Hour {
+			return nil
+		}
+		tlsLog.Info("Self-signed certificate is expiring, generating a new one", "cert", certFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	dnsNames, ips := hostSANs()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ctrlsrv"},
+			CommonName:   dnsNames[0],
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644); err != nil {
+		return err
+	}
+
+	tlsLog.Info("Generated self-signed certificate", "dns_names", dnsNames, "ips", ips)
+	return nil
+}
+
+// hostSANs returns the host name variants and interface addresses this
+// machine is reachable by. Link-local addresses are skipped since they
+// depend on the interface and are not usable in URLs without a zone.
+func hostSANs() ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" && host != "localhost" {
+		dnsNames = []string{host, host + ".local", "localhost"}
+	}
+
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		tlsLog.Warn("Cannot list interface addresses", "error", err)
+		return dnsNames, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return dnsNames, ips
+}
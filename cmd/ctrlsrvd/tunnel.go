@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// tunnelALPN identifies the reverse tunnel protocol. The edge opens one
+// bidirectional stream per client connection and speaks plain HTTP/1.1 on
+// it; ctrlsrvd serves those streams with the regular API handler.
+const tunnelALPN = "ctrlsrv-tunnel/1"
+
+// Tunnel timing
+const (
+	tunnelMinBackoff  = time.Second
+	tunnelMaxBackoff  = time.Minute
+	tunnelStableAfter = 30 * time.Second
+	tunnelPathCheck   = 10 * time.Second
+	tunnelProbeTime   = 5 * time.Second
+	tunnelAlertAfter  = 2 * time.Minute
+)
+
+// Tunnel states
+const (
+	TunnelDisabled   = "disabled"
+	TunnelConnecting = "connecting"
+	TunnelConnected  = "connected"
+	TunnelBackoff    = "backoff"
+)
+
+// TunnelStatus describes the reverse tunnel to the edge
+type TunnelStatus struct {
+	Endpoint       string    `json:"endpoint,omitempty"`
+	State          string    `json:"state"`
+	ConnectedSince time.Time `json:"connected_since,omitempty"`
+	LocalAddr      string    `json:"local_addr,omitempty"`
+	RemoteAddr     string    `json:"remote_addr,omitempty"`
+	RTTMillis      float64   `json:"rtt_ms"`
+	Reconnects     int       `json:"reconnects"`
+	Migrations     int       `json:"migrations"`
+	ActiveStreams  int64     `json:"active_streams"`
+	Requests       uint64    `json:"requests"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastErrorAt    time.Time `json:"last_error_at,omitempty"`
+	NextAttempt    time.Time `json:"next_attempt,omitempty"`
+}
+
+// Tunnel keeps an outbound QUIC connection to the edge so API requests can
+// reach this box behind CGNAT. It reconnects with exponential backoff and
+// moves the connection to a new path when the local address changes.
+type Tunnel struct {
+	config  *Config
+	handler http.Handler
+
+	mu        sync.Mutex
+	status    TunnelStatus
+	conn      *quic.Conn
+	server    *http.Server
+	downSince time.Time
+	closing   bool
+
+	streams  atomic.Int64
+	requests atomic.Uint64
+	migrate  chan struct{}
+}
+
+// NewTunnel creates a tunnel serving handler to the configured edge
+func NewTunnel(cfg *Config, handler http.Handler) *Tunnel {
+	t := &Tunnel{
+		config:    cfg,
+		handler:   handler,
+		status:    TunnelStatus{Endpoint: cfg.Edge.Endpoint, State: TunnelDisabled},
+		downSince: time.Now(),
+		migrate:   make(chan struct{}, 1),
+	}
+	if cfg.Edge.Endpoint != "" {
+		t.status.State = TunnelConnecting
+	}
+	return t
+}
+
+// tlsConfig builds the client TLS configuration: our certificate for the
+// edge to authenticate us, and the CA the edge's certificate must chain to
+func (t *Tunnel) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(t.config.Edge.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid edge endpoint: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(t.config.Edge.ClientCert, t.config.Edge.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load edge client certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:   host,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{tunnelALPN},
+	}
+	if t.config.Edge.CAFile != "" {
+		if tlsConfig.RootCAs, err = loadClientCAs(t.config.Edge.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Run maintains the tunnel until ctx is cancelled
+func (t *Tunnel) Run(ctx context.Context) {
+	if t.config.Edge.Endpoint == "" {
+		return
+	}
+
+	backoff := tunnelMinBackoff
+	for {
+		t.setState(TunnelConnecting, time.Time{})
+		started := time.Now()
+		// Reloaded for every attempt so renewed certificates are picked up
+		tlsConfig, err := t.tlsConfig()
+		if err == nil {
+			err = t.connect(ctx, tlsConfig)
+		}
+		if ctx.Err() != nil || t.isClosing() {
+			return
+		}
+		// A connection that stayed up for a while starts a fresh backoff
+		if time.Since(started) > tunnelStableAfter {
+			backoff = tunnelMinBackoff
+		}
+		tunnelLog.Warn("Edge tunnel down", "endpoint", t.config.Edge.Endpoint, "error", err)
+		t.setError(err)
+
+		// Jitter keeps a fleet of boxes from reconnecting in lockstep
+		wait := backoff/2 + rand.N(backoff/2+1)
+		t.setState(TunnelBackoff, time.Now().Add(wait))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, tunnelMaxBackoff)
+
+		t.mu.Lock()
+		t.status.Reconnects++
+		t.mu.Unlock()
+	}
+}
+
+// connect dials the edge and serves requests until the connection ends
+func (t *Tunnel) connect(ctx context.Context, tlsConfig *tls.Config) error {
+	addr, err := net.ResolveUDPAddr("udp", t.config.Edge.Endpoint)
+	if err != nil {
+		return err
+	}
+	tr, err := newTunnelTransport()
+	if err != nil {
+		return err
+	}
+	// Transports of abandoned paths stay open until the connection ends,
+	// since closing a transport closes the connections using it
+	transports := []*quic.Transport{tr}
+	defer func() {
+		for _, tr := range transports {
+			tr.Close()
+			tr.Conn.Close()
+		}
+	}()
+
+	dialCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	conn, err := tr.Dial(dialCtx, addr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:  30 * time.Second,
+		KeepAlivePeriod: 10 * time.Second,
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           t.countRequests(t.handler),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	localIP := routeSourceIP(addr)
+	local := tunnelLocalAddr(localIP, tr)
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		conn.CloseWithError(0, "shutting down")
+		return nil
+	}
+	t.conn = conn
+	t.server = server
+	t.status.State = TunnelConnected
+	t.status.ConnectedSince = time.Now()
+	t.status.LocalAddr = local
+	t.status.RemoteAddr = conn.RemoteAddr().String()
+	t.status.NextAttempt = time.Time{}
+	t.downSince = time.Time{}
+	t.mu.Unlock()
+	tunnelLog.Info("Edge tunnel connected", "remote", conn.RemoteAddr().String(), "local", local)
+
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	go server.Serve(&tunnelListener{ctx: listenCtx, stop: stopListening, conn: conn, streams: &t.streams})
+
+	ticker := time.NewTicker(tunnelPathCheck)
+	defer ticker.Stop()
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			conn.CloseWithError(0, "shutting down")
+			done = nil
+		case <-conn.Context().Done():
+			server.Close()
+			t.mu.Lock()
+			t.conn = nil
+			t.server = nil
+			t.downSince = time.Now()
+			t.mu.Unlock()
+			return context.Cause(conn.Context())
+		case <-ticker.C:
+			ip := routeSourceIP(addr)
+			if ip == nil || ip.Equal(localIP) {
+				continue
+			}
+			tunnelLog.Info("Local address for edge changed, migrating tunnel", "old", localIP, "new", ip)
+			localIP = ip
+			transports = t.migratePath(ctx, conn, localIP, transports)
+		case <-t.migrate:
+			localIP = routeSourceIP(addr)
+			transports = t.migratePath(ctx, conn, localIP, transports)
+		}
+	}
+}
+
+// migratePath moves conn to a fresh socket after a local network change so
+// the edge sees a validated new path instead of stale NAT state. If the new
+// path cannot be validated the connection is closed and redialed.
+func (t *Tunnel) migratePath(ctx context.Context, conn *quic.Conn, localIP net.IP, transports []*quic.Transport) []*quic.Transport {
+	tr, err := newTunnelTransport()
+	if err != nil {
+		tunnelLog.Warn("Tunnel migration failed", "error", err)
+		return transports
+	}
+	transports = append(transports, tr)
+
+	path, err := conn.AddPath(tr)
+	if err == nil {
+		probeCtx, cancel := context.WithTimeout(ctx, tunnelProbeTime)
+		err = path.Probe(probeCtx)
+		cancel()
+		if err == nil {
+			err = path.Switch()
+		}
+	}
+	if err != nil {
+		tunnelLog.Warn("Tunnel migration failed, reconnecting", "error", err)
+		conn.CloseWithError(0, "path migration failed")
+		return transports
+	}
+
+	local := tunnelLocalAddr(localIP, tr)
+	t.mu.Lock()
+	t.status.Migrations++
+	t.status.LocalAddr = local
+	t.mu.Unlock()
+	tunnelLog.Info("Edge tunnel migrated", "local", local)
+	return transports
+}
+
+// Migrate moves the tunnel to a new local socket, as if the network changed
+func (t *Tunnel) Migrate() {
+	select {
+	case t.migrate <- struct{}{}:
+	default:
+	}
+}
+
+// newTunnelTransport opens a UDP socket for the tunnel
+func newTunnelTransport() (*quic.Transport, error) {
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: udp}, nil
+}
+
+// routeSourceIP returns the local address the kernel would use to reach
+// addr. Connecting a UDP socket sends nothing.
+func routeSourceIP(addr *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// tunnelLocalAddr formats the source address of a tunnel socket, which is
+// bound to the wildcard address
+func tunnelLocalAddr(ip net.IP, tr *quic.Transport) string {
+	port := tr.Conn.LocalAddr().(*net.UDPAddr).Port
+	return net.JoinHostPort(ip.String(), fmt.Sprint(port))
+}
+
+// tunnelKey marks requests that arrived through the edge tunnel
+type tunnelKey struct{}
+
+// viaTunnel reports whether r arrived through the edge tunnel. Its peer
+// address is the edge's socket, which may be on this host, so such
+// requests are never treated as local.
+func viaTunnel(r *http.Request) bool {
+	return r.Context().Value(tunnelKey{}) != nil
+}
+
+// countRequests tracks requests served through the tunnel and marks them
+// for metrics
+func (t *Tunnel) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.requests.Add(1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tunnelKey{}, true)))
+	})
+}
+
+// Shutdown stops accepting requests from the edge, waits for in-flight
+// ones until ctx expires and closes the connection. Run returns afterwards.
+func (t *Tunnel) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	conn, server := t.conn, t.server
+	t.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	err := server.Shutdown(ctx)
+	conn.CloseWithError(0, "shutting down")
+	return err
+}
+
+func (t *Tunnel) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+func (t *Tunnel) setState(state string, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.State = state
+	t.status.NextAttempt = next
+}
+
+func (t *Tunnel) setError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.LastError = err.Error()
+	t.status.LastErrorAt = time.Now()
+}
+
+// Status returns the current tunnel status
+func (t *Tunnel) Status() TunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := t.status
+	if t.conn != nil {
+		status.RTTMillis = float64(t.conn.ConnectionStats().SmoothedRTT.Microseconds()) / 1000
+	} else {
+		status.ConnectedSince = time.Time{}
+		status.LocalAddr, status.RemoteAddr = "", ""
+	}
+	status.ActiveStreams = t.streams.Load()
+	status.Requests = t.requests.Load()
+	return status
+}
+
+// Alerts returns a health alert when the tunnel has been down for a while
+func (t *Tunnel) Alerts() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config.Edge.Endpoint == "" || t.conn != nil || time.Since(t.downSince) < tunnelAlertAfter {
+		return nil
+	}
+	alert := "Edge tunnel down since " + t.downSince.Format("15:04")
+	if t.status.LastError != "" {
+		alert += ": " + t.status.LastError
+	}
+	return []string{alert}
+}
+
+// tunnelListener accepts the streams the edge opens as connections
+type tunnelListener struct {
+	ctx     context.Context
+	stop    context.CancelFunc
+	conn    *quic.Conn
+	streams *atomic.Int64
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	stream, err := l.conn.AcceptStream(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.streams.Add(1)
+	return &tunnelConn{Stream: stream, conn: l.conn, streams: l.streams}, nil
+}
+
+func (l *tunnelListener) Close() error {
+	l.stop()
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// tunnelConn adapts a QUIC stream to net.Conn
+type tunnelConn struct {
+	*quic.Stream
+	conn    *quic.Conn
+	streams *atomic.Int64
+	closed  sync.Once
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *tunnelConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close closes both directions; quic.Stream.Close only ends the send side
+func (c *tunnelConn) Close() error {
+	c.closed.Do(func() { c.streams.Add(-1) })
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
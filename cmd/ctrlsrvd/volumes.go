@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Volume roles
+const (
+	VolumeRolePrimary = "primary"
+	VolumeRoleBackup  = "backup"
+	VolumeRoleMedia   = "media"
+)
+
+// VolumeStatus reports the state of one configured storage volume
+type VolumeStatus struct {
+	Name      string   `json:"name"`
+	Path      string   `json:"path"`
+	Role      string   `json:"role"`
+	Mandatory bool     `json:"mandatory"`
+	Services  []string `json:"services"`
+	Available bool     `json:"available"`
+	Error     string   `json:"error,omitempty"`
+	Used      uint64   `json:"used_bytes"`
+	Free      uint64   `json:"free_bytes"`
+	Total     uint64   `json:"total_bytes"`
+	UsedPct   float64  `json:"used_percent"`
+}
+
+// checkVolume checks availability and usage of a single volume
+func checkVolume(v VolumeConfig) VolumeStatus {
+	status := VolumeStatus{
+		Name:      v.Name,
+		Path:      v.Path,
+		Role:      v.Role,
+		Mandatory: v.Mandatory,
+		Services:  v.Services,
+	}
+	if status.Services == nil {
+		status.Services = []string{}
+	}
+
+	if err := checkStorage(v.Path); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Available = true
+
+	used, free, total, err := getStorageUsage(v.Path)
+	if err == nil {
+		status.Used = used
+		status.Free = free
+		status.Total = total
+		if total > 0 {
+			status.UsedPct = float64(used) / float64(total) * 100
+		}
+	}
+	return status
+}
+
+// checkVolumes checks every configured volume
+func checkVolumes(volumes []VolumeConfig) []VolumeStatus {
+	statuses := make([]VolumeStatus, 0, len(volumes))
+	for _, v := range volumes {
+		statuses = append(statuses, checkVolume(v))
+	}
+	return statuses
+}
+
+// checkMandatoryVolumes returns an error for the first unavailable mandatory
+// volume and logs a warning for unavailable optional ones
+func checkMandatoryVolumes(volumes []VolumeConfig) error {
+	for _, v := range volumes {
+		if err := checkStorage(v.Path); err != nil {
+			if v.Mandatory {
+				return fmt.Errorf("volume %s: %w", v.Name, err)
+			}
+			storageLog.Warn("Optional volume unavailable", "volume", v.Name, "error", err)
+		}
+	}
+	return nil
+}
+
+// validateVolumes checks volume names, roles and that there is one primary
+func validateVolumes(volumes []VolumeConfig) error {
+	names := make(map[string]bool)
+	primaries := 0
+	for _, v := range volumes {
+		if v.Name == "" || v.Path == "" {
+			return fmt.Errorf("storage volume needs a name and path")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate storage volume name: %s", v.Name)
+		}
+		names[v.Name] = true
+
+		switch v.Role {
+		case VolumeRolePrimary:
+			primaries++
+		case VolumeRoleBackup, VolumeRoleMedia:
+		default:
+			return fmt.Errorf("storage volume %s has unknown role: %q", v.Name, v.Role)
+		}
+	}
+	if primaries != 1 {
+		return fmt.Errorf("exactly one primary storage volume required, found %d", primaries)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events that indicate a file was added,
+// removed, renamed or finished being written
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// watchTree recursively watches root with inotify and calls notify with the
+// full path of every changed file or directory. Directories for which skip
+// returns true are not watched. It returns when ctx is cancelled (Linux).
+func watchTree(ctx context.Context, root string, skip func(name string) bool, notify func(path string)) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("inotify init: %w", err)
+	}
+
+	var mu sync.Mutex
+	dirs := make(map[int32]string)
+
+	addTree := func(dir string) {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if path != root && skip(d.Name()) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(fd, path, watchMask)
+			if err != nil {
+				// Usually fs.inotify.max_user_watches; the caller's periodic
+				// rescan still picks up changes below this point
+				storageLog.Warn("Cannot watch directory", "path", path, "error", err)
+				return filepath.SkipDir
+			}
+			mu.Lock()
+			dirs[int32(wd)] = path
+			mu.Unlock()
+			return nil
+		})
+	}
+	addTree(root)
+
+	// Unblock the read loop on shutdown
+	go func() {
+		<-ctx.Done()
+		syscall.Close(fd)
+	}()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := syscall.Read(fd, buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return fmt.Errorf("inotify read: %w", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			mu.Lock()
+			dir, ok := dirs[event.Wd]
+			if event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_IGNORED) != 0 {
+				delete(dirs, event.Wd)
+			}
+			mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			if name == "" {
+				continue
+			}
+			path := filepath.Join(dir, name)
+
+			// New directories need watches of their own
+			if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && !skip(name) {
+				addTree(path)
+			}
+			notify(path)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Command edge-standin is a minimal local replacement for the edge proxy,
+// for developing and testing the ctrlsrvd reverse tunnel. It accepts the
+// tunnel on a QUIC port and relays plain HTTP requests from a local port
+// through it, one QUIC stream per client connection.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// tunnelALPN must match the protocol ctrlsrvd dials with
+const tunnelALPN = "ctrlsrv-tunnel/1"
+
+var (
+	tunnelAddr = flag.String("tunnel-addr", "127.0.0.1:4443", "UDP address ctrlsrvd dials (edge.endpoint)")
+	httpAddr   = flag.String("http-addr", "127.0.0.1:8081", "Local HTTP address relayed through the tunnel")
+	certFile   = flag.String("cert", "", "Server certificate (default: generate one for localhost)")
+	keyFile    = flag.String("key", "", "Server key")
+	certOut    = flag.String("cert-out", "edge-standin.pem", "Where to write the generated certificate, for edge.ca_file")
+	clientCA   = flag.String("client-ca", "", "CA for ctrlsrvd's client certificate (default: accept any)")
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("TLS setup failed: %v", err)
+	}
+	ln, err := quic.ListenAddr(*tunnelAddr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:  30 * time.Second,
+		KeepAlivePeriod: 10 * time.Second,
+	})
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *tunnelAddr, err)
+	}
+	log.Printf("Waiting for ctrlsrvd tunnel on %s", *tunnelAddr)
+
+	var current atomic.Pointer[quic.Conn]
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				log.Fatalf("Accept failed: %v", err)
+			}
+			cn := conn.ConnectionState().TLS.PeerCertificates[0].Subject.CommonName
+			log.Printf("Tunnel from %q at %s", cn, conn.RemoteAddr())
+			if old := current.Swap(conn); old != nil {
+				old.CloseWithError(0, "replaced by a new tunnel")
+			}
+			go watchPath(conn)
+		}
+	}()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: "http", Host: "ctrlsrv"})
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn := current.Load()
+				if conn == nil {
+					return nil, fmt.Errorf("no tunnel connected")
+				}
+				stream, err := conn.OpenStreamSync(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return &streamConn{Stream: stream, conn: conn}, nil
+			},
+			IdleConnTimeout: time.Minute,
+		},
+		FlushInterval: -1,
+	}
+	log.Printf("Relaying http://%s through the tunnel", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, proxy))
+}
+
+// watchPath logs when ctrlsrvd migrates the connection to a new address
+func watchPath(conn *quic.Conn) {
+	addr := conn.RemoteAddr().String()
+	for {
+		select {
+		case <-conn.Context().Done():
+			log.Printf("Tunnel from %s closed: %v", addr, context.Cause(conn.Context()))
+			return
+		case <-time.After(time.Second):
+		}
+		if now := conn.RemoteAddr().String(); now != addr {
+			log.Printf("Tunnel migrated from %s to %s", addr, now)
+			addr = now
+		}
+	}
+}
+
+// serverTLSConfig loads or generates the certificate ctrlsrvd verifies
+func serverTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if *certFile != "" {
+		cert, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+	} else {
+		cert, err = generateCert()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{tunnelALPN},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	if *clientCA != "" {
+		data, err := os.ReadFile(*clientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", *clientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// generateCert creates a throwaway certificate for localhost and writes it
+// to -cert-out so ctrlsrvd can trust it
+func generateCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "edge-standin"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(*certOut, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Wrote certificate to %s; set edge.ca_file to it", *certOut)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// streamConn adapts a QUIC stream to net.Conn
+type streamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
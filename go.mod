@@ -4,13 +4,14 @@ go 1.24
 
 require (
 	github.com/quic-go/quic-go v0.56.0
+	golang.org/x/crypto v0.41.0
 	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
 	github.com/kr/text v0.1.0 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
-	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect